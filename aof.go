@@ -2,40 +2,95 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Aof struct {
-	file *os.File
-	rd   *bufio.Reader
-	mu   sync.Mutex
+	path  string
+	file  *os.File
+	mu    sync.Mutex
+	fsync string
+	dirty bool
+	done  chan struct{}
+
+	// while a rewrite runs, writes are also collected in rewriteBuf and
+	// appended to the new file before it replaces the old one
+	rewriting     bool
+	rewriteBuf    []byte
+	rewriteStart  time.Time
+	lastRewriteOk bool
+	baseSize      int64
+	rewrites      int
 }
 
-func NewAof(path string) (*Aof, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+// rewriteBatch is how many list elements or set and sorted set members a
+// rewritten command carries at most.
+const rewriteBatch = 64
+
+var ErrRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+
+// AOF is the open append-only file, or nil when appendonly is off.
+var AOF *Aof
+
+// NewAof opens the log at path. fsync is the appendfsync policy: "always"
+// syncs after every write, "everysec" from a background goroutine once a
+// second, and "no" leaves flushing to the operating system.
+func NewAof(path string, fsync string) (*Aof, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, err
 	}
-	aof := &Aof{file: file, rd: bufio.NewReader(file)}
+	aof := &Aof{path: path, file: file, fsync: fsync, done: make(chan struct{}), lastRewriteOk: true}
+	if info, err := file.Stat(); err == nil {
+		aof.baseSize = info.Size()
+	}
 
-	go func() {
-		for {
+	if fsync == "everysec" {
+		go aof.syncEverySecond()
+	}
+
+	return aof, nil
+}
+
+func (aof *Aof) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-aof.done:
+			return
+		case <-ticker.C:
 			aof.mu.Lock()
-			aof.file.Sync()
+			if aof.dirty {
+				if err := aof.file.Sync(); err != nil {
+					fmt.Println("aof fsync failed:", err)
+				}
+				aof.dirty = false
+			}
 			aof.mu.Unlock()
-			time.Sleep(1 * time.Second)
 		}
-	}()
-
-	return aof, nil
+	}
 }
 
 func (aof *Aof) Close() error {
+	close(aof.done)
+
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
+	if err := aof.file.Sync(); err != nil {
+		aof.file.Close()
+		return err
+	}
 	return aof.file.Close()
 }
 
@@ -43,26 +98,391 @@ func (aof *Aof) Write(value Value) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	_, err := aof.file.Write(value.Marshal())
-	return err
+	bytes := value.Marshal()
+	if aof.rewriting {
+		aof.rewriteBuf = append(aof.rewriteBuf, bytes...)
+	}
+	if _, err := aof.file.Write(bytes); err != nil {
+		return err
+	}
+	if aof.fsync == "always" {
+		return aof.file.Sync()
+	}
+	aof.dirty = true
+	return nil
 }
 
-func (aof *Aof) Read(fn func(value Value)) error {
+// Read replays the log through fn. A log whose last command was cut off,
+// as happens when the server dies mid-write, is truncated back to the last
+// complete command with a warning if loadTruncated is set, and refused
+// otherwise.
+func (aof *Aof) Read(fn func(value Value), loadTruncated bool) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	aof.file.Seek(0, io.SeekStart)
+	if _, err := aof.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
 
-	reader := NewResp(aof.file)
+	valid, err := scanAof(aof.file, loadEntries, fn)
+	if err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if !loadTruncated {
+		return &AofError{valid, "unexpected end of file"}
+	}
+
+	fmt.Printf("!!! Warning: short read while loading the AOF file %s, truncating it to %d bytes\n", aof.path, valid)
+	if err := aof.file.Truncate(valid); err != nil {
+		return err
+	}
+	aof.baseSize = valid
+	return nil
+}
+
+// AofError reports a malformed record in an append-only file.
+type AofError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *AofError) Error() string {
+	return fmt.Sprintf("aof: %s at offset %d", e.Msg, e.Offset)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// scanAof reads a log from r, handing an RDB preamble to load (when not
+// nil) and every command after it to fn. It returns the offset just past
+// the last complete command. A log that ends in the middle of a command
+// returns io.ErrUnexpectedEOF, a malformed one an *AofError or *RdbError.
+func scanAof(r io.Reader, load func([]rdbEntry), fn func(value Value)) (int64, error) {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+	offset := func() int64 {
+		return cr.n - int64(br.Buffered())
+	}
+
+	// a rewritten log may start with an RDB snapshot, followed by the
+	// commands that ran while it was being written
+	if hasSnapshot(br) {
+		entries, err := decodeSnapshot(br)
+		if err != nil {
+			return 0, err
+		}
+		if load != nil {
+			load(entries)
+		}
+	}
+
+	// share br so that offset() accounts for what the parser consumed
+	reader := &Resp{reader: br}
 	for {
+		valid := offset()
 		value, err := reader.Read()
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return valid, err
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
+			return valid, &AofError{valid, err.Error()}
+		}
+		if value.typ != "array" || len(value.array) == 0 {
+			return valid, &AofError{valid, "expected a command array"}
+		}
+		for _, arg := range value.array {
+			if arg.typ != "bulk" {
+				return valid, &AofError{valid, "expected bulk string arguments"}
 			}
-			return err
 		}
 		fn(value)
 	}
+}
+
+// BgRewrite regenerates the log from the current keyspace on another
+// goroutine and swaps it in for the old one.
+func (aof *Aof) BgRewrite() error {
+	// holding writeMu lines the snapshot up with the start of rewriteBuf:
+	// every write is either in the snapshot or in the buffer, never both
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.rewriting {
+		return ErrRewriteInProgress
+	}
+	entries := DB.Snapshot()
+	preamble := instance.RdbPreamble()
+	aof.rewriting = true
+	aof.rewriteBuf = nil
+	aof.rewriteStart = time.Now()
+
+	go func() {
+		err := aof.rewrite(entries, preamble)
+		if err != nil {
+			fmt.Println("aof rewrite failed:", err)
+		}
+
+		aof.mu.Lock()
+		aof.rewriting = false
+		aof.rewriteBuf = nil
+		aof.lastRewriteOk = err == nil
+		if err == nil {
+			aof.rewrites++
+		}
+		aof.mu.Unlock()
+	}()
 	return nil
 }
+
+func (aof *Aof) rewrite(entries []rdbEntry, preamble bool) error {
+	dir := filepath.Dir(aof.path)
+	tmp, err := createTemp(aof.path, fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	if preamble {
+		var progress atomic.Int64
+		if err := encodeRdb(w, entries, &progress); err != nil {
+			return fail(err)
+		}
+	} else {
+		for _, e := range entries {
+			for _, command := range rewriteCommands(e) {
+				if _, err := w.Write(command.Marshal()); err != nil {
+					return fail(err)
+				}
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if _, err := tmp.Write(aof.rewriteBuf); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp.Name(), aof.path); err != nil {
+		return fail(err)
+	}
+	if err := syncDir(dir); err != nil {
+		fmt.Println("aof rewrite: directory fsync failed:", err)
+	}
+
+	// tmp is positioned at its end, so later writes append to it
+	aof.file.Close()
+	aof.file = tmp
+	aof.dirty = false
+	if info, err := tmp.Stat(); err == nil {
+		aof.baseSize = info.Size()
+	}
+	return nil
+}
+
+// rewriteCommands returns the shortest command sequence that recreates e.
+func rewriteCommands(e rdbEntry) []Value {
+	bulk := func(s string) Value {
+		return Value{typ: "bulk", bulk: s}
+	}
+
+	var commands []Value
+	switch v := e.obj.value.(type) {
+	case string:
+		commands = append(commands, Value{typ: "array", array: []Value{bulk("SET"), bulk(e.key), bulk(v)}})
+	case map[string]string:
+		for field, value := range v {
+			commands = append(commands, Value{typ: "array", array: []Value{bulk("HSET"), bulk(e.key), bulk(field), bulk(value)}})
+		}
+	case []string:
+		commands = append(commands, batchCommands("RPUSH", e.key, v)...)
+	case map[string]struct{}:
+		members := make([]string, 0, len(v))
+		for member := range v {
+			members = append(members, member)
+		}
+		commands = append(commands, batchCommands("SADD", e.key, members)...)
+	case *ZSET:
+		var command Value
+		v.treap.Each(func(node *TreapNode) {
+			if len(command.array) == 0 {
+				command = Value{typ: "array", array: []Value{bulk("ZADD"), bulk(e.key)}}
+			}
+			command.array = append(command.array, bulk(formatDouble(node.key)), bulk(node.value))
+			if len(command.array) == 2+2*rewriteBatch {
+				commands = append(commands, command)
+				command = Value{}
+			}
+		})
+		if len(command.array) > 0 {
+			commands = append(commands, command)
+		}
+	}
+
+	if e.expire != -1 {
+		commands = append(commands, Value{typ: "array", array: []Value{
+			bulk("PEXPIREAT"), bulk(e.key), bulk(strconv.FormatInt(e.expire, 10)),
+		}})
+	}
+	return commands
+}
+
+// batchCommands splits name key elem... into commands of at most
+// rewriteBatch elements.
+func batchCommands(name, key string, elems []string) []Value {
+	var commands []Value
+	for start := 0; start < len(elems); start += rewriteBatch {
+		command := Value{typ: "array", array: []Value{{typ: "bulk", bulk: name}, {typ: "bulk", bulk: key}}}
+		for _, elem := range elems[start:min(start+rewriteBatch, len(elems))] {
+			command.array = append(command.array, Value{typ: "bulk", bulk: elem})
+		}
+		commands = append(commands, command)
+	}
+	return commands
+}
+
+// Cron starts a rewrite once the log has grown by percentage percent since
+// the last rewrite (or since startup) and is at least minSize bytes.
+func (aof *Aof) Cron(config *Config) {
+	for {
+		time.Sleep(time.Second)
+
+		percentage, minSize := config.AofRewriteRules()
+		if percentage <= 0 {
+			continue
+		}
+
+		aof.mu.Lock()
+		rewriting, base := aof.rewriting, aof.baseSize
+		size, err := aof.size()
+		aof.mu.Unlock()
+		if err != nil || rewriting || size < minSize {
+			continue
+		}
+
+		if base == 0 {
+			base = 1
+		}
+		if growth := (size - base) * 100 / base; growth >= int64(percentage) {
+			fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+			if err := aof.BgRewrite(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// size returns the current length of the log. The caller must hold mu.
+func (aof *Aof) size() (int64, error) {
+	info, err := aof.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Info returns the aof_* fields of INFO persistence.
+func (aof *Aof) Info() string {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	inProgress, current := 0, int64(-1)
+	if aof.rewriting {
+		inProgress = 1
+		current = int64(time.Since(aof.rewriteStart).Seconds())
+	}
+	status := "ok"
+	if !aof.lastRewriteOk {
+		status = "err"
+	}
+	size, _ := aof.size()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", inProgress)
+	fmt.Fprintf(&b, "aof_current_rewrite_time_sec:%d\r\n", current)
+	fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", status)
+	fmt.Fprintf(&b, "aof_rewrites:%d\r\n", aof.rewrites)
+	fmt.Fprintf(&b, "aof_current_size:%d\r\n", size)
+	fmt.Fprintf(&b, "aof_base_size:%d\r\n", aof.baseSize)
+	return b.String()
+}
+
+// aofCommand rewrites commands whose effect depends on when they run, so
+// that replaying the log later restores the same expiry times: relative
+// TTLs become PEXPIREAT and SET ... PXAT with an absolute unix time.
+func aofCommand(value Value) Value {
+	command := strings.ToUpper(value.array[0].bulk)
+	args := value.array[1:]
+
+	switch command {
+	case "EXPIRE", "PEXPIRE", "EXPIREAT":
+		if len(args) < 2 {
+			return value
+		}
+		n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+		if err != nil {
+			return value
+		}
+		when, ok := absoluteExpire(command, n)
+		if !ok {
+			return value
+		}
+		res := Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "PEXPIREAT"},
+			args[0],
+			{typ: "bulk", bulk: strconv.FormatInt(when, 10)},
+		}}
+		res.array = append(res.array, args[2:]...)
+		return res
+	case "SET":
+		res := Value{typ: "array", array: []Value{value.array[0]}}
+		for i := 0; i < len(args); i++ {
+			opt := strings.ToUpper(args[i].bulk)
+			if (opt == "EX" || opt == "PX" || opt == "EXAT") && i >= 2 && i+1 < len(args) {
+				n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+				if err != nil {
+					return value
+				}
+				when, ok := absoluteExpire(opt, n)
+				if !ok {
+					return value
+				}
+				res.array = append(res.array,
+					Value{typ: "bulk", bulk: "PXAT"},
+					Value{typ: "bulk", bulk: strconv.FormatInt(when, 10)})
+				i++
+				continue
+			}
+			res.array = append(res.array, args[i])
+		}
+		return res
+	}
+	return value
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// waiter is a client blocked in BZPOPMIN, BZPOPMAX or BZMPOP until one of
+// its keys holds a sorted set.
+type waiter struct {
+	keys    []string
+	timeout time.Duration // 0 waits forever
+	serve   popServer
+	reply   chan Value
+	done    bool
+}
+
+// popServer pops for a blocking command from the sorted set o at key. It
+// returns the reply and the command the pop is logged as. The caller must
+// hold writeMu and DB.mu.
+type popServer func(key string, o *Object) (reply, command Value)
+
+// blocked lists the waiters of each key, oldest first.
+var blocked = map[string][]*waiter{}
+var blockedMu sync.Mutex
+var blockedCount atomic.Int64
+
+func parseTimeout(s string) (time.Duration, Value, bool) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, Value{typ: "error", str: "ERR timeout is not a float or out of range"}, false
+	}
+	if seconds < 0 {
+		return 0, Value{typ: "error", str: "ERR timeout is negative"}, false
+	}
+	return time.Duration(seconds * float64(time.Second)), Value{}, true
+}
+
+// blockingPop pops from the first of keys holding a sorted set. When none
+// does, c blocks until a write creates one or the timeout passes.
+func blockingPop(c *Client, keys []string, timeout time.Duration, serve popServer) Value {
+	reply, w := tryPop(keys, timeout, serve)
+	if w == nil {
+		return reply
+	}
+	return c.block(w)
+}
+
+// tryPop pops right away if it can, and otherwise registers a waiter on
+// keys. Holding writeMu means no write can slip in between the two.
+func tryPop(keys []string, timeout time.Duration, serve popServer) (Value, *waiter) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if reply, command, ok := popFirst(keys, serve); ok {
+		if command.typ != "" {
+			propagate(command)
+		}
+		return reply, nil
+	}
+
+	w := &waiter{keys: keys, timeout: timeout, serve: serve, reply: make(chan Value, 1)}
+	blockedMu.Lock()
+	for _, key := range keys {
+		blocked[key] = append(blocked[key], w)
+	}
+	blockedMu.Unlock()
+	blockedCount.Add(1)
+	return Value{}, w
+}
+
+func popFirst(keys []string, serve popServer) (reply, command Value, ok bool) {
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	for _, key := range keys {
+		o, ok := DB.LookupType(key, "zset")
+		if !ok {
+			return WrongType, Value{}, true
+		}
+		if o != nil {
+			reply, command := serve(key, o)
+			return reply, command, true
+		}
+	}
+	return Value{}, Value{}, false
+}
+
+// wait returns the reply for w, or a null reply once its timeout passes.
+func (w *waiter) wait() Value {
+	if w.timeout > 0 {
+		timer := time.NewTimer(w.timeout)
+		defer timer.Stop()
+		select {
+		case reply := <-w.reply:
+			return reply
+		case <-timer.C:
+			w.cancel()
+		}
+	}
+	return <-w.reply
+}
+
+// cancel unblocks w with a null reply unless it has been served already.
+func (w *waiter) cancel() {
+	blockedMu.Lock()
+	defer blockedMu.Unlock()
+
+	if !w.done {
+		w.unblock()
+		w.reply <- Value{typ: "nullarray"}
+	}
+}
+
+// unblock takes w off every key it waits on. The caller must hold
+// blockedMu.
+func (w *waiter) unblock() {
+	w.done = true
+	blockedCount.Add(-1)
+	for _, key := range w.keys {
+		waiters := blocked[key][:0]
+		for _, other := range blocked[key] {
+			if other != w {
+				waiters = append(waiters, other)
+			}
+		}
+		if len(waiters) == 0 {
+			delete(blocked, key)
+		} else {
+			blocked[key] = waiters
+		}
+	}
+}
+
+// serveBlocked hands the sorted sets created by the last write to the
+// clients waiting on their keys, oldest first. The caller must hold
+// writeMu.
+func serveBlocked() {
+	if blockedCount.Load() == 0 {
+		return
+	}
+	DB.mu.Lock()
+	ready := DB.ready
+	DB.ready = nil
+	DB.mu.Unlock()
+
+	for _, key := range ready {
+		for serveFirst(key) {
+		}
+	}
+}
+
+// serveFirst pops key for its oldest waiter, reporting whether it did.
+func serveFirst(key string) bool {
+	blockedMu.Lock()
+	defer blockedMu.Unlock()
+
+	if len(blocked[key]) == 0 {
+		return false
+	}
+	w := blocked[key][0]
+
+	DB.mu.Lock()
+	o, ok := DB.LookupType(key, "zset")
+	if !ok || o == nil {
+		DB.mu.Unlock()
+		return false
+	}
+	reply, command := w.serve(key, o)
+	DB.mu.Unlock()
+
+	w.unblock()
+	propagate(command)
+	w.reply <- reply
+	return true
+}
+
+func BlockedCount() int64 {
+	return blockedCount.Load()
+}
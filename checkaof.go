@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// checkAof implements `check-aof [--fix] <file>`. It validates an
+// append-only file, reports the offset of the first bad record and, with
+// --fix, truncates the file there so the server can load what comes
+// before it. It returns the exit status.
+func checkAof(args []string) int {
+	fix := len(args) > 0 && args[0] == "--fix"
+	if fix {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		fmt.Println("Usage: check-aof [--fix] <file.aof>")
+		return 1
+	}
+	path := args[0]
+
+	flag := os.O_RDONLY
+	if fix {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	commands := 0
+	valid, err := scanAof(file, nil, func(Value) {
+		commands++
+	})
+	fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d, commands=%d\n", info.Size(), valid, info.Size()-valid, commands)
+	if err == nil {
+		fmt.Println("AOF is valid")
+		return 0
+	}
+
+	var rdbErr *RdbError
+	if errors.As(err, &rdbErr) {
+		// cutting the file inside the snapshot would throw away every key
+		fmt.Println("RDB preamble is not valid:", err)
+		return 1
+	}
+	if err == io.ErrUnexpectedEOF {
+		fmt.Printf("Unexpected end of file, the command at offset %d is incomplete\n", valid)
+	} else {
+		fmt.Println(err)
+	}
+
+	if !fix {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		return 1
+	}
+	if err := file.Truncate(valid); err != nil {
+		fmt.Println("Failed to truncate AOF:", err)
+		return 1
+	}
+	if err := file.Sync(); err != nil {
+		fmt.Println("Failed to sync AOF:", err)
+		return 1
+	}
+	fmt.Printf("Successfully truncated AOF to %d bytes\n", valid)
+	return 0
+}
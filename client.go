@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type Client struct {
+	id     int64
+	name   string
+	proto  int
+	conn   net.Conn
+	resp   *Resp
+	writer *Write
+	waiter *waiter // the blocking command an event loop client is parked on
+
+	// input read while blocked, and the error that ended it
+	pending []byte
+	readErr error
+}
+
+var clients = map[int64]*Client{}
+var clientsMu sync.Mutex
+var nextClientId int64
+
+func NewClient(conn net.Conn) *Client {
+	c := &Client{conn: conn, proto: 2}
+	if conn != nil {
+		c.resp = NewResp(flushReader{c})
+		c.writer = NewWrite(conn)
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	nextClientId++
+	c.id = nextClientId
+	clients[c.id] = c
+	return c
+}
+
+// flushReader sits between the connection and the request parser. Replies
+// are only flushed when the parser runs out of buffered input, so a
+// pipelined batch is answered with a single write.
+type flushReader struct {
+	c *Client
+}
+
+func (f flushReader) Read(p []byte) (int, error) {
+	if len(f.c.pending) > 0 {
+		n := copy(p, f.c.pending)
+		f.c.pending = f.c.pending[n:]
+		return n, nil
+	}
+	if f.c.readErr != nil {
+		return 0, f.c.readErr
+	}
+	if err := f.c.writer.Flush(); err != nil {
+		return 0, err
+	}
+	return f.c.conn.Read(p)
+}
+
+func (c *Client) Close() error {
+	clientsMu.Lock()
+	delete(clients, c.id)
+	clientsMu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	c.writer.Flush()
+	return c.conn.Close()
+}
+
+// block waits for w to be served. Clients of the event loop must not hold
+// up its thread, so they get a "blocked" value instead and the loop sends
+// the reply when it comes.
+func (c *Client) block(w *waiter) Value {
+	if c.conn == nil {
+		c.waiter = w
+		return Value{typ: "blocked"}
+	}
+	// replies pipelined ahead of the blocking command go out now
+	if err := c.writer.Flush(); err != nil {
+		w.cancel()
+	}
+	defer c.watch(w)()
+	return w.wait()
+}
+
+// watch reads from the connection while c is blocked on w, so a client
+// that disconnects stops waiting instead of being handed a pop nobody
+// receives. What it reads is kept for the parser. The returned func stops
+// the watch.
+func (c *Client) watch(w *waiter) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := c.conn.Read(buf)
+			c.pending = append(c.pending, buf[:n]...)
+			if err == nil && len(c.pending) > maxQueryLen {
+				err = errors.New("closing client that reached max query buffer length")
+			}
+			if err != nil {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					c.readErr = err
+					w.cancel()
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *Client) SetProto(proto int) {
+	c.proto = proto
+	if c.writer != nil {
+		c.writer.proto = proto
+	}
+}
+
+func ClientCount() int {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return len(clients)
+}
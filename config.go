@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
@@ -9,10 +10,22 @@ import (
 )
 
 type Config struct {
-	file       *os.File
-	mu         sync.RWMutex
-	AppendOnly bool
-	Save       []SaveConfig
+	file        *os.File
+	mu          sync.RWMutex
+	AppendOnly  bool
+	AppendFsync string
+
+	AofUseRdbPreamble        bool
+	AofLoadTruncated         bool
+	AutoAofRewritePercentage int
+	AutoAofRewriteMinSize    int64
+	Save                     []SaveConfig
+	IoMode                   string
+	RdbFormat                string
+
+	MaxMemory        int64
+	MaxMemoryPolicy  string
+	MaxMemorySamples int
 }
 type SaveConfig struct {
 	Seconds int
@@ -30,7 +43,17 @@ func NewConfig(path string) (*Config, error) {
 			initErr = err
 			return
 		}
-		instance = &Config{file: file}
+		instance = &Config{
+			file:                     file,
+			AppendFsync:              "everysec",
+			AofLoadTruncated:         true,
+			AutoAofRewritePercentage: 100,
+			AutoAofRewriteMinSize:    64 * 1024 * 1024,
+			IoMode:                   "goroutine",
+			RdbFormat:                "lredis",
+			MaxMemoryPolicy:          "noeviction",
+			MaxMemorySamples:         5,
+		}
 	})
 	if initErr != nil {
 		return nil, initErr
@@ -57,8 +80,46 @@ func (r *Config) ReadConfig() error {
 		switch parts[0] {
 		case "appendonly":
 			r.AppendOnly = parts[1] == "yes"
+		case "appendfsync":
+			if parts[1] == "always" || parts[1] == "everysec" || parts[1] == "no" {
+				r.AppendFsync = parts[1]
+			}
+		case "aof-use-rdb-preamble":
+			r.AofUseRdbPreamble = parts[1] == "yes"
+		case "aof-load-truncated":
+			r.AofLoadTruncated = parts[1] == "yes"
+		case "auto-aof-rewrite-percentage":
+			if n, err := strconv.Atoi(parts[1]); err == nil && n >= 0 {
+				r.AutoAofRewritePercentage = n
+			}
+		case "auto-aof-rewrite-min-size":
+			if n, err := parseMemory(parts[1]); err == nil {
+				r.AutoAofRewriteMinSize = n
+			}
+		case "io-mode":
+			if parts[1] == "goroutine" || parts[1] == "epoll" {
+				r.IoMode = parts[1]
+			}
+		case "rdb-format":
+			if parts[1] == "lredis" || parts[1] == "redis" {
+				r.RdbFormat = parts[1]
+			}
+		case "maxmemory":
+			if n, err := parseMemory(parts[1]); err == nil {
+				r.MaxMemory = n
+			}
+		case "maxmemory-policy":
+			if evictionPolicies[parts[1]] {
+				r.MaxMemoryPolicy = parts[1]
+			}
+		case "maxmemory-samples":
+			if n, err := strconv.Atoi(parts[1]); err == nil && n > 0 {
+				r.MaxMemorySamples = n
+			}
 		case "save":
-			if len(parts) == 3 {
+			if parts[1] == `""` {
+				r.Save = nil
+			} else if len(parts) == 3 {
 				seconds, err1 := strconv.Atoi(parts[1])
 				changes, err2 := strconv.Atoi(parts[2])
 				if err1 == nil && err2 == nil {
@@ -74,3 +135,216 @@ func (r *Config) ReadConfig() error {
 	_, err := r.file.Seek(0, 0)
 	return err
 }
+
+// AofRewriteRules returns the automatic rewrite thresholds; a percentage
+// of 0 turns automatic rewrites off.
+func (r *Config) AofRewriteRules() (percentage int, minSize int64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.AutoAofRewritePercentage, r.AutoAofRewriteMinSize
+}
+
+func (r *Config) RdbPreamble() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.AofUseRdbPreamble
+}
+
+// SnapshotFormat returns the format snapshots are written in: "lredis" for our
+// own or "redis" for the one Redis reads. Both are accepted when loading.
+func (r *Config) SnapshotFormat() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.RdbFormat
+}
+
+func (r *Config) SaveRules() []SaveConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Save
+}
+
+// configParams lists the parameters CONFIG GET reports, in order.
+var configParams = []string{
+	"aof-load-truncated",
+	"aof-use-rdb-preamble",
+	"appendfsync",
+	"appendonly",
+	"auto-aof-rewrite-min-size",
+	"auto-aof-rewrite-percentage",
+	"io-mode",
+	"maxmemory",
+	"maxmemory-policy",
+	"maxmemory-samples",
+	"rdb-format",
+	"save",
+}
+
+// Get returns the current value of a parameter in redis.config syntax.
+func (r *Config) Get(name string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	switch name {
+	case "appendonly":
+		if r.AppendOnly {
+			return "yes", true
+		}
+		return "no", true
+	case "appendfsync":
+		return r.AppendFsync, true
+	case "aof-use-rdb-preamble":
+		if r.AofUseRdbPreamble {
+			return "yes", true
+		}
+		return "no", true
+	case "aof-load-truncated":
+		if r.AofLoadTruncated {
+			return "yes", true
+		}
+		return "no", true
+	case "auto-aof-rewrite-min-size":
+		return strconv.FormatInt(r.AutoAofRewriteMinSize, 10), true
+	case "auto-aof-rewrite-percentage":
+		return strconv.Itoa(r.AutoAofRewritePercentage), true
+	case "io-mode":
+		return r.IoMode, true
+	case "maxmemory":
+		return strconv.FormatInt(r.MaxMemory, 10), true
+	case "maxmemory-policy":
+		return r.MaxMemoryPolicy, true
+	case "maxmemory-samples":
+		return strconv.Itoa(r.MaxMemorySamples), true
+	case "rdb-format":
+		return r.RdbFormat, true
+	case "save":
+		rules := make([]string, 0, len(r.Save))
+		for _, rule := range r.Save {
+			rules = append(rules, fmt.Sprintf("%d %d", rule.Seconds, rule.Changes))
+		}
+		return strings.Join(rules, " "), true
+	}
+	return "", false
+}
+
+// Set changes a parameter at runtime. Only parameters that can take
+// effect without a restart are accepted.
+func (r *Config) Set(name, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch name {
+	case "aof-use-rdb-preamble":
+		if value != "yes" && value != "no" {
+			return fmt.Errorf("invalid aof-use-rdb-preamble %q", value)
+		}
+		r.AofUseRdbPreamble = value == "yes"
+	case "auto-aof-rewrite-min-size":
+		n, err := parseMemory(value)
+		if err != nil {
+			return err
+		}
+		r.AutoAofRewriteMinSize = n
+	case "auto-aof-rewrite-percentage":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid auto-aof-rewrite-percentage %q", value)
+		}
+		r.AutoAofRewritePercentage = n
+	case "maxmemory":
+		n, err := parseMemory(value)
+		if err != nil {
+			return err
+		}
+		r.MaxMemory = n
+	case "maxmemory-policy":
+		if !evictionPolicies[value] {
+			return fmt.Errorf("invalid maxmemory-policy %q", value)
+		}
+		r.MaxMemoryPolicy = value
+	case "maxmemory-samples":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid maxmemory-samples %q", value)
+		}
+		r.MaxMemorySamples = n
+	case "rdb-format":
+		if value != "lredis" && value != "redis" {
+			return fmt.Errorf("invalid rdb-format %q", value)
+		}
+		r.RdbFormat = value
+	case "save":
+		rules, err := parseSaveRules(value)
+		if err != nil {
+			return err
+		}
+		r.Save = rules
+	default:
+		return fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	return nil
+}
+
+// parseSaveRules parses "<seconds> <changes> ..." pairs; an empty string
+// disables automatic snapshots.
+func parseSaveRules(value string) ([]SaveConfig, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save rules %q", value)
+	}
+
+	var rules []SaveConfig
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.Atoi(fields[i+1])
+		if err1 != nil || err2 != nil || seconds <= 0 || changes < 0 {
+			return nil, fmt.Errorf("invalid save rules %q", value)
+		}
+		rules = append(rules, SaveConfig{Seconds: seconds, Changes: changes})
+	}
+	return rules, nil
+}
+
+var evictionPolicies = map[string]bool{
+	"noeviction":      true,
+	"allkeys-lru":     true,
+	"volatile-lru":    true,
+	"allkeys-lfu":     true,
+	"volatile-lfu":    true,
+	"allkeys-random":  true,
+	"volatile-random": true,
+	"volatile-ttl":    true,
+}
+
+// Eviction returns the maxmemory settings; a limit of 0 means unlimited.
+func (r *Config) Eviction() (maxmemory int64, policy string, samples int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.MaxMemory, r.MaxMemoryPolicy, r.MaxMemorySamples
+}
+
+// parseMemory parses sizes like redis.conf does: 1k is 1000 bytes, 1kb is
+// 1024, and the same for m/mb and g/gb.
+func parseMemory(s string) (int64, error) {
+	s = strings.ToLower(s)
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mul = strings.TrimSuffix(s, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return n * mul, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// convertRdb implements `convert-rdb <lredis|redis> <in> <out>`. It reads
+// a snapshot in either format and writes it to out in the one given, to
+// seed the server from a Redis dump or hand a snapshot back to Redis. It
+// returns the exit status.
+func convertRdb(args []string) int {
+	if len(args) != 3 || args[0] != "lredis" && args[0] != "redis" {
+		fmt.Println("Usage: convert-rdb <lredis|redis> <in.rdb> <out.rdb>")
+		return 1
+	}
+
+	in, err := os.Open(args[1])
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer in.Close()
+
+	entries, err := decodeSnapshot(bufio.NewReader(in))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	encode := encodeRdb
+	if args[0] == "redis" {
+		encode = encodeRedisRdb
+	}
+	var buffer bytes.Buffer
+	var progress atomic.Int64
+	if err := encode(&buffer, entries, &progress); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err := os.WriteFile(args[2], buffer.Bytes(), 0666); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("Converted %d keys from %s to %s\n", len(entries), args[1], args[2])
+	return 0
+}
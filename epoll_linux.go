@@ -0,0 +1,294 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+type epollConn struct {
+	fd      int
+	client  *Client
+	in      []byte
+	scanner requestScanner
+	out     []byte
+	writing bool
+	blocked bool
+}
+
+type Epoll struct {
+	epfd  int
+	lfd   int
+	wake  [2]int // pipe that wakes the loop when a blocked command is done
+	conns map[int]*epollConn
+
+	mu      sync.Mutex
+	replies []epollReply
+}
+
+// epollReply is the reply to a parked blocking command, handed back to the
+// loop by the goroutine that waited for it.
+type epollReply struct {
+	ec    *epollConn
+	reply Value
+}
+
+// ServeEpoll runs every client on a single thread: one epoll instance
+// watches the listening socket and all client sockets, and commands are
+// dispatched straight from the read loop.
+func ServeEpoll(port int) error {
+	lfd, err := listenTCP(port)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(lfd)
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(epfd)
+
+	ep := &Epoll{epfd: epfd, lfd: lfd, conns: map[int]*epollConn{}}
+	if err := ep.ctl(syscall.EPOLL_CTL_ADD, lfd, syscall.EPOLLIN); err != nil {
+		return err
+	}
+	if err := syscall.Pipe2(ep.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		return err
+	}
+	defer syscall.Close(ep.wake[0])
+	defer syscall.Close(ep.wake[1])
+	if err := ep.ctl(syscall.EPOLL_CTL_ADD, ep.wake[0], syscall.EPOLLIN); err != nil {
+		return err
+	}
+	return ep.loop()
+}
+
+func listenTCP(port int) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: port}); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (ep *Epoll) ctl(op int, fd int, events uint32) error {
+	event := syscall.EpollEvent{Events: events, Fd: int32(fd)}
+	return syscall.EpollCtl(ep.epfd, op, fd, &event)
+}
+
+func (ep *Epoll) loop() error {
+	events := make([]syscall.EpollEvent, 128)
+	buf := make([]byte, 16*1024)
+
+	for {
+		n, err := syscall.EpollWait(ep.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == ep.lfd {
+				ep.accept()
+				continue
+			}
+			if fd == ep.wake[0] {
+				ep.unpark(buf)
+				continue
+			}
+
+			ec, ok := ep.conns[fd]
+			if !ok {
+				continue
+			}
+			ev := events[i].Events
+			if ev&(syscall.EPOLLIN|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				if !ep.read(ec, buf) {
+					ep.close(ec)
+					continue
+				}
+			}
+			if len(ec.out) > 0 && !ep.flush(ec) {
+				ep.close(ec)
+			}
+		}
+	}
+}
+
+func (ep *Epoll) accept() {
+	for {
+		fd, _, err := syscall.Accept4(ep.lfd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if err != nil {
+			if err != syscall.EAGAIN && err != syscall.EINTR {
+				fmt.Println(err)
+			}
+			return
+		}
+		if err := ep.ctl(syscall.EPOLL_CTL_ADD, fd, syscall.EPOLLIN|syscall.EPOLLRDHUP); err != nil {
+			fmt.Println(err)
+			syscall.Close(fd)
+			continue
+		}
+		ep.conns[fd] = &epollConn{fd: fd, client: NewClient(nil)}
+	}
+}
+
+// read drains the socket into the client buffer and runs every complete
+// command in it. It returns false when the connection should be closed.
+func (ep *Epoll) read(ec *epollConn, buf []byte) bool {
+	for {
+		n, err := syscall.Read(ec.fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.EAGAIN {
+				break
+			}
+			return false
+		}
+		if n == 0 {
+			return false
+		}
+		ec.in = append(ec.in, buf[:n]...)
+		if len(ec.in) > maxQueryLen {
+			fmt.Println("closing client that reached max query buffer length")
+			return false
+		}
+	}
+	return ep.process(ec)
+}
+
+// process runs the complete commands buffered for ec until it runs out of
+// them or one blocks. It returns false when the connection should be
+// closed.
+func (ep *Epoll) process(ec *epollConn) bool {
+	consumed := 0
+	for consumed < len(ec.in) && !ec.blocked {
+		if !ec.scanner.scan(ec.in[consumed:]) {
+			break
+		}
+		ec.scanner = requestScanner{}
+		value, n, err := ParseCommand(ec.in[consumed:])
+		if err == ErrIncomplete {
+			break
+		}
+		if err == nil && (value.typ != "array" || len(value.array) == 0) {
+			err = &ProtocolError{"expected array"}
+		}
+		if err != nil {
+			ec.out = append(ec.out, Value{typ: "error", str: "ERR " + err.Error()}.Marshal()...)
+			ep.flush(ec)
+			return false
+		}
+		consumed += n
+
+		result := dispatch(ec.client, value)
+		if result.typ == "blocked" {
+			ep.park(ec)
+			continue
+		}
+		ec.out = append(ec.out, result.MarshalResp(ec.client.proto)...)
+	}
+	ec.in = ec.in[:copy(ec.in, ec.in[consumed:])]
+	return true
+}
+
+// park waits for the blocking command of ec off the loop thread. Commands
+// pipelined behind it stay buffered until the reply comes.
+func (ep *Epoll) park(ec *epollConn) {
+	ec.blocked = true
+	w := ec.client.waiter
+	go func() {
+		reply := w.wait()
+		ep.mu.Lock()
+		ep.replies = append(ep.replies, epollReply{ec, reply})
+		ep.mu.Unlock()
+		syscall.Write(ep.wake[1], []byte{0})
+	}()
+}
+
+// unpark sends the replies of the blocking commands that are done and
+// resumes the commands behind them.
+func (ep *Epoll) unpark(buf []byte) {
+	for {
+		if n, err := syscall.Read(ep.wake[0], buf); n <= 0 || err != nil {
+			break
+		}
+	}
+	ep.mu.Lock()
+	replies := ep.replies
+	ep.replies = nil
+	ep.mu.Unlock()
+
+	for _, r := range replies {
+		ec := r.ec
+		// the connection was closed while it waited
+		if ep.conns[ec.fd] != ec {
+			continue
+		}
+		ec.blocked = false
+		ec.client.waiter = nil
+		ec.out = append(ec.out, r.reply.MarshalResp(ec.client.proto)...)
+		if !ep.process(ec) || !ep.flush(ec) {
+			ep.close(ec)
+		}
+	}
+}
+
+// flush writes as much pending output as the socket accepts and waits for
+// EPOLLOUT when the kernel buffer is full.
+func (ep *Epoll) flush(ec *epollConn) bool {
+	for len(ec.out) > 0 {
+		n, err := syscall.Write(ec.fd, ec.out)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.EAGAIN {
+				if !ec.writing {
+					ec.writing = true
+					return ep.ctl(syscall.EPOLL_CTL_MOD, ec.fd, syscall.EPOLLIN|syscall.EPOLLOUT|syscall.EPOLLRDHUP) == nil
+				}
+				return true
+			}
+			return false
+		}
+		ec.out = ec.out[n:]
+	}
+
+	ec.out = nil
+	if ec.writing {
+		ec.writing = false
+		return ep.ctl(syscall.EPOLL_CTL_MOD, ec.fd, syscall.EPOLLIN|syscall.EPOLLRDHUP) == nil
+	}
+	return true
+}
+
+func (ep *Epoll) close(ec *epollConn) {
+	if ec.blocked {
+		ec.client.waiter.cancel()
+	}
+	ep.ctl(syscall.EPOLL_CTL_DEL, ec.fd, 0)
+	syscall.Close(ec.fd)
+	delete(ep.conns, ec.fd)
+	ec.client.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func ServeEpoll(port int) error {
+	return errors.New("io-mode epoll is only supported on linux")
+}
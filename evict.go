@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// Rough per-entry overheads of the Go structures behind each type. They do
+// not need to be exact, only to grow with the data so maxmemory means
+// something.
+const (
+	keyOverhead   = 64
+	hashOverhead  = 32
+	zsetOverhead  = 96
+	listOverhead  = 16
+	setOverhead   = 48
+	lfuInitVal    = 5
+	lfuLogFactor  = 10
+	lfuDecayMs    = 60 * 1000
+	oomErrMessage = "OOM command not allowed when used memory > 'maxmemory'."
+)
+
+func objectSize(key string, o *Object) int64 {
+	size := int64(keyOverhead + len(key))
+	switch v := o.value.(type) {
+	case string:
+		size += int64(len(v))
+	case map[string]string:
+		for field, value := range v {
+			size += hashEntrySize(field, value)
+		}
+	case []string:
+		for _, elem := range v {
+			size += listEntrySize(elem)
+		}
+	case map[string]struct{}:
+		for member := range v {
+			size += setEntrySize(member)
+		}
+	case *ZSET:
+		for member := range v.elements {
+			size += zsetEntrySize(member)
+		}
+	}
+	return size
+}
+
+func hashEntrySize(field, value string) int64 {
+	return int64(hashOverhead + len(field) + len(value))
+}
+
+func zsetEntrySize(member string) int64 {
+	return int64(zsetOverhead + len(member))
+}
+
+func listEntrySize(elem string) int64 {
+	return int64(listOverhead + len(elem))
+}
+
+func setEntrySize(member string) int64 {
+	return int64(setOverhead + len(member))
+}
+
+// touch records an access: it refreshes the LRU clock and bumps the LFU
+// counter after decaying it for the time the key sat idle.
+func (o *Object) touch() {
+	now := nowMs()
+	o.lfu = lfuLogIncr(o.lfuDecayed(now))
+	o.lru = now
+}
+
+// lfuDecayed returns the LFU counter with one point taken off for every
+// decay period since the last access.
+func (o *Object) lfuDecayed(now int64) uint8 {
+	periods := (now - o.lru) / lfuDecayMs
+	if periods >= int64(o.lfu) {
+		return 0
+	}
+	return o.lfu - uint8(periods)
+}
+
+// lfuLogIncr increments the counter with a probability that falls as it
+// grows, so 255 stands for millions of accesses rather than 255.
+func lfuLogIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return 255
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1.0/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// Evict deletes keys chosen by policy until used memory fits in maxmemory,
+// and returns them so the caller can log their deletion. Each victim is
+// the best of samples keys picked at random, as Redis does. ok is false
+// when memory is still over the limit because the policy has no
+// candidates left. The caller must hold mu.
+func (ks *Keyspace) Evict(maxmemory int64, policy string, samples int) (victims []string, ok bool) {
+	for ks.used > maxmemory {
+		if policy == "noeviction" {
+			return victims, false
+		}
+		key, ok := ks.evictionCandidate(policy, samples)
+		if !ok {
+			return victims, false
+		}
+		ks.Delete(key)
+		victims = append(victims, key)
+	}
+	return victims, true
+}
+
+func (ks *Keyspace) evictionCandidate(policy string, samples int) (string, bool) {
+	volatile := policy == "volatile-lru" || policy == "volatile-lfu" ||
+		policy == "volatile-random" || policy == "volatile-ttl"
+
+	var keys []string
+	if volatile {
+		for key := range ks.expires {
+			if len(keys) == samples {
+				break
+			}
+			keys = append(keys, key)
+		}
+	} else {
+		for key := range ks.data {
+			if len(keys) == samples {
+				break
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "", false
+	}
+
+	now := nowMs()
+	best, bestScore := "", int64(0)
+	for i, key := range keys {
+		var score int64 // lower is evicted first
+		switch policy {
+		case "allkeys-lru", "volatile-lru":
+			score = ks.data[key].lru
+		case "allkeys-lfu", "volatile-lfu":
+			score = int64(ks.data[key].lfuDecayed(now))
+		case "volatile-ttl":
+			score = ks.expires[key]
+		default:
+			score = rand.Int63()
+		}
+		if i == 0 || score < bestScore {
+			best, bestScore = key, score
+		}
+	}
+	return best, true
+}
@@ -2,39 +2,113 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"strconv"
-	"sync"
+	"strings"
 )
 
 var Handler = map[string]func([]Value) Value{
-	"PING":   ping,
-	"SET":    set,
-	"GET":    get,
-	"HSET":   hset,
-	"HGET":   hget,
-	"SAVE":   save,
-	"DEL":    del,
-	"ZCARD":  zcard,
-	"ZADD":   zadd,
-	"ZRANGE": zrange,
-	"ZREM":   zrem,
+	"PING":             ping,
+	"SET":              set,
+	"GET":              get,
+	"HSET":             hset,
+	"HGET":             hget,
+	"HGETALL":          hgetall,
+	"SAVE":             save,
+	"BGSAVE":           bgsave,
+	"LASTSAVE":         lastsave,
+	"INFO":             info,
+	"CONFIG":           configCommand,
+	"BGREWRITEAOF":     bgrewriteaof,
+	"DEL":              del,
+	"UNLINK":           del,
+	"EXISTS":           exists,
+	"TYPE":             typeCommand,
+	"KEYS":             keys,
+	"SCAN":             scan,
+	"EXPIRE":           expire,
+	"PEXPIRE":          pexpire,
+	"EXPIREAT":         expireat,
+	"PEXPIREAT":        pexpireat,
+	"TTL":              ttl,
+	"PTTL":             pttl,
+	"EXPIRETIME":       expiretime,
+	"PEXPIRETIME":      pexpiretime,
+	"PERSIST":          persist,
+	"ZCARD":            zcard,
+	"ZADD":             zadd,
+	"ZRANGE":           zrange,
+	"ZREM":             zrem,
+	"ZINCRBY":          zincrby,
+	"ZSCORE":           zscore,
+	"ZMSCORE":          zmscore,
+	"ZRANK":            zrank,
+	"ZREVRANK":         zrevrank,
+	"ZCOUNT":           zcount,
+	"ZREVRANGE":        zrevrange,
+	"ZRANGEBYSCORE":    zrangebyscore,
+	"ZREVRANGEBYSCORE": zrevrangebyscore,
+	"ZREMRANGEBYRANK":  zremrangebyrank,
+	"ZREMRANGEBYSCORE": zremrangebyscore,
+	"ZRANGEBYLEX":      zrangebylex,
+	"ZREVRANGEBYLEX":   zrevrangebylex,
+	"ZLEXCOUNT":        zlexcount,
+	"ZREMRANGEBYLEX":   zremrangebylex,
+	"ZUNION":           zunion,
+	"ZINTER":           zinter,
+	"ZDIFF":            zdiff,
+	"ZUNIONSTORE":      zunionstore,
+	"ZINTERSTORE":      zinterstore,
+	"ZDIFFSTORE":       zdiffstore,
+	"ZINTERCARD":       zintercard,
+	"ZPOPMIN":          zpopmin,
+	"ZPOPMAX":          zpopmax,
+	"ZMPOP":            zmpop,
+	"ZRANDMEMBER":      zrandmember,
+	"RPUSH":            rpush,
+	"SADD":             sadd,
 }
 
-var SETs = map[string]string{}
-var SETsMu = sync.RWMutex{}
-
-var HSETs = map[string]map[string]string{}
-var HSETsMu = sync.RWMutex{}
+const (
+	cmdWrite   = 1 << iota // modifies the keyspace
+	cmdDenyOOM             // may use more memory, refused over maxmemory
+)
 
-type ZSET struct {
-	treap    *Treap
-	elements map[string]*TreapNode
-	mu       sync.RWMutex
+var commandFlags = map[string]int{
+	"SET":              cmdWrite | cmdDenyOOM,
+	"HSET":             cmdWrite | cmdDenyOOM,
+	"DEL":              cmdWrite,
+	"UNLINK":           cmdWrite,
+	"EXPIRE":           cmdWrite,
+	"PEXPIRE":          cmdWrite,
+	"EXPIREAT":         cmdWrite,
+	"PEXPIREAT":        cmdWrite,
+	"PERSIST":          cmdWrite,
+	"ZADD":             cmdWrite | cmdDenyOOM,
+	"ZREM":             cmdWrite,
+	"ZINCRBY":          cmdWrite | cmdDenyOOM,
+	"ZREMRANGEBYRANK":  cmdWrite,
+	"ZREMRANGEBYSCORE": cmdWrite,
+	"ZREMRANGEBYLEX":   cmdWrite,
+	"ZUNIONSTORE":      cmdWrite | cmdDenyOOM,
+	"ZINTERSTORE":      cmdWrite | cmdDenyOOM,
+	"ZDIFFSTORE":       cmdWrite | cmdDenyOOM,
+	"ZPOPMIN":          cmdWrite,
+	"ZPOPMAX":          cmdWrite,
+	"ZMPOP":            cmdWrite,
+	"RPUSH":            cmdWrite | cmdDenyOOM,
+	"SADD":             cmdWrite | cmdDenyOOM,
 }
 
-var ZSETsMu sync.RWMutex
-
-var ZSETs = map[string]*ZSET{}
+// ClientHandler holds the commands that act on the calling connection
+// rather than on the keyspace, and the blocking commands, which may have
+// to park it.
+var ClientHandler = map[string]func(*Client, []Value) Value{
+	"HELLO":    hello,
+	"BZPOPMIN": bzpopmin,
+	"BZPOPMAX": bzpopmax,
+	"BZMPOP":   bzmpop,
+}
 
 func ping(args []Value) Value {
 	if len(args) == 0 {
@@ -44,15 +118,61 @@ func ping(args []Value) Value {
 }
 
 func set(args []Value) Value {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return Value{typ: "error", str: "set wrong number of arguments"}
 	}
 	key := args[0].bulk
 	value := args[1].bulk
 
-	SETsMu.Lock()
-	SETs[key] = value
-	SETsMu.Unlock()
+	var nx, xx, keepTTL bool
+	expire := int64(-1)
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expire != -1 || i+1 == len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			i++
+			n, err := strconv.ParseInt(args[i].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+			when, ok := absoluteExpire(opt, n)
+			if n <= 0 || !ok {
+				return Value{typ: "error", str: "ERR invalid expire time in 'set' command"}
+			}
+			expire = when
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+	if nx && xx || keepTTL && expire != -1 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	exists := DB.Lookup(key) != nil
+	if nx && exists || xx && !exists {
+		return Value{typ: "null"}
+	}
+
+	ttl := DB.Expire(key)
+	DB.Set(key, &Object{typ: "string", value: value})
+	if keepTTL && ttl != -1 {
+		DB.SetExpire(key, ttl)
+	}
+	if expire != -1 {
+		DB.SetExpire(key, expire)
+	}
 	return Value{typ: "string", str: "OK"}
 }
 
@@ -62,14 +182,17 @@ func get(args []Value) Value {
 	}
 	key := args[0].bulk
 
-	SETsMu.RLock()
-	value, ok := SETs[key]
-	SETsMu.RUnlock()
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
 
+	o, ok := DB.LookupType(key, "string")
 	if !ok {
+		return WrongType
+	}
+	if o == nil {
 		return Value{typ: "null"}
 	}
-	return Value{typ: "bulk", bulk: value}
+	return Value{typ: "bulk", bulk: o.value.(string)}
 }
 
 func hset(args []Value) Value {
@@ -81,12 +204,24 @@ func hset(args []Value) Value {
 	key := args[1].bulk
 	value := args[2].bulk
 
-	HSETsMu.Lock()
-	if _, ok := HSETs[hash]; !ok {
-		HSETs[hash] = map[string]string{}
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(hash, "hash")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		o = &Object{typ: "hash", value: map[string]string{}}
+		DB.Set(hash, o)
 	}
-	HSETs[hash][key] = value
-	HSETsMu.Unlock()
+	fields := o.value.(map[string]string)
+	if old, exists := fields[key]; exists {
+		DB.Grow(o, int64(len(value)-len(old)))
+	} else {
+		DB.Grow(o, hashEntrySize(key, value))
+	}
+	fields[key] = value
 	return Value{typ: "string", str: "OK"}
 }
 
@@ -97,153 +232,580 @@ func hget(args []Value) Value {
 
 	hash := args[0].bulk
 	key := args[1].bulk
-	HSETsMu.RLock()
-	value, ok := HSETs[hash][key]
-	HSETsMu.RUnlock()
 
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(hash, "hash")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		return Value{typ: "null"}
+	}
+	value, ok := o.value.(map[string]string)[key]
 	if !ok {
 		return Value{typ: "null"}
 	}
 	return Value{typ: "bulk", bulk: value}
 }
 
+func hgetall(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "hgetall wrong number of arguments"}
+	}
+
+	hash := args[0].bulk
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(hash, "hash")
+	if !ok {
+		return WrongType
+	}
+	res := Value{typ: "map", array: []Value{}}
+	if o == nil {
+		return res
+	}
+	for key, value := range o.value.(map[string]string) {
+		res.array = append(res.array, Value{typ: "bulk", bulk: key}, Value{typ: "bulk", bulk: value})
+	}
+	return res
+}
+
 func save(args []Value) Value {
 	if len(args) != 0 {
 		return Value{typ: "error", str: "save wrong number of arguments"}
 	}
 
-	rdb, err := NewRdb("database.rdb")
-	if err != nil {
-		return Value{typ: "error", str: err.Error()}
-	}
-	err = rdb.Save()
-	if err != nil {
-		return Value{typ: "error", str: err.Error()}
+	if err := RDB.Save(); err != nil {
+		return Value{typ: "error", str: "ERR " + err.Error()}
 	}
 
 	return Value{typ: "string", str: "OK"}
 }
 
+func bgsave(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "bgsave wrong number of arguments"}
+	}
+
+	if err := RDB.BgSave(); err != nil {
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+	return Value{typ: "string", str: "Background saving started"}
+}
+
+func bgrewriteaof(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "bgrewriteaof wrong number of arguments"}
+	}
+	if AOF == nil {
+		return Value{typ: "error", str: "ERR append only file is disabled"}
+	}
+
+	if err := AOF.BgRewrite(); err != nil {
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+	return Value{typ: "string", str: "Background append only file rewriting started"}
+}
+
+func lastsave(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "lastsave wrong number of arguments"}
+	}
+	return Value{typ: "integer", num: int(RDB.LastSave().Unix())}
+}
+
+func info(args []Value) Value {
+	if len(args) > 1 {
+		return Value{typ: "error", str: "info wrong number of arguments"}
+	}
+	section := "all"
+	if len(args) == 1 {
+		section = strings.ToLower(args[0].bulk)
+	}
+
+	var b strings.Builder
+	show := func(name string) bool {
+		if section != "all" && section != "default" && section != name {
+			return false
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(name[:1])+name[1:])
+		return true
+	}
+
+	if show("server") {
+		fmt.Fprintf(&b, "redis_version:%s\r\n", serverVersion)
+		fmt.Fprintf(&b, "tcp_port:%d\r\n", port)
+	}
+	if show("clients") {
+		fmt.Fprintf(&b, "connected_clients:%d\r\n", ClientCount())
+		fmt.Fprintf(&b, "blocked_clients:%d\r\n", BlockedCount())
+	}
+	if show("memory") {
+		maxmemory, policy, _ := instance.Eviction()
+		DB.mu.RLock()
+		fmt.Fprintf(&b, "used_memory:%d\r\n", DB.UsedMemory())
+		DB.mu.RUnlock()
+		fmt.Fprintf(&b, "maxmemory:%d\r\n", maxmemory)
+		fmt.Fprintf(&b, "maxmemory_policy:%s\r\n", policy)
+	}
+	if show("persistence") {
+		b.WriteString(RDB.Info())
+		if AOF != nil {
+			b.WriteString("aof_enabled:1\r\n")
+			b.WriteString(AOF.Info())
+		} else {
+			b.WriteString("aof_enabled:0\r\n")
+		}
+	}
+	if show("keyspace") {
+		DB.mu.RLock()
+		if n := DB.Len(); n > 0 {
+			fmt.Fprintf(&b, "db0:keys=%d,expires=%d\r\n", n, len(DB.expires))
+		}
+		DB.mu.RUnlock()
+	}
+
+	return Value{typ: "verbatim", str: "txt", bulk: b.String()}
+}
+
+func configCommand(args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "config wrong number of arguments"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "GET":
+		if len(args) < 2 {
+			return Value{typ: "error", str: "config get wrong number of arguments"}
+		}
+		res := Value{typ: "map", array: []Value{}}
+		for _, name := range configParams {
+			for _, pattern := range args[1:] {
+				if globMatch(strings.ToLower(pattern.bulk), name) {
+					value, _ := instance.Get(name)
+					res.array = append(res.array, Value{typ: "bulk", bulk: name}, Value{typ: "bulk", bulk: value})
+					break
+				}
+			}
+		}
+		return res
+	case "SET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return Value{typ: "error", str: "config set wrong number of arguments"}
+		}
+		for i := 1; i < len(args); i += 2 {
+			if err := instance.Set(strings.ToLower(args[i].bulk), args[i+1].bulk); err != nil {
+				return Value{typ: "error", str: "ERR " + err.Error()}
+			}
+		}
+		return Value{typ: "string", str: "OK"}
+	}
+	return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'"}
+}
+
 func del(args []Value) Value {
-	if len(args) != 1 {
+	if len(args) == 0 {
 		return Value{typ: "error", str: "del wrong number of arguments"}
 	}
-	key := args[0].bulk
 
-	HSETsMu.Lock()
-	delete(HSETs, key)
-	HSETsMu.Unlock()
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	cnt := 0
+	for _, arg := range args {
+		if DB.Delete(arg.bulk) {
+			cnt++
+		}
+	}
+	return Value{typ: "integer", num: cnt}
+}
+
+func exists(args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "exists wrong number of arguments"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	cnt := 0
+	for _, arg := range args {
+		if DB.Peek(arg.bulk) != nil {
+			cnt++
+		}
+	}
+	return Value{typ: "integer", num: cnt}
+}
+
+func typeCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "type wrong number of arguments"}
+	}
 
-	SETsMu.Lock()
-	delete(SETs, key)
-	SETsMu.Unlock()
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
 
-	return Value{typ: "string", str: "ok"}
+	o := DB.Peek(args[0].bulk)
+	if o == nil {
+		return Value{typ: "string", str: "none"}
+	}
+	return Value{typ: "string", str: o.typ}
 }
 
-func zadd(args []Value) Value {
-	n := len(args)
-	if n < 2 || n%2 == 0 {
-		return Value{typ: "error", str: "zadd wrong number of arguments"}
+func keys(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "keys wrong number of arguments"}
 	}
-	key := args[0].bulk
+	pattern := args[0].bulk
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	res := Value{typ: "array", array: []Value{}}
+	for key := range DB.data {
+		if globMatch(pattern, key) && DB.Peek(key) != nil {
+			res.array = append(res.array, Value{typ: "bulk", bulk: key})
+		}
+	}
+	return res
+}
 
-	ZSETsMu.Lock()
-	zset, exists := ZSETs[key]
-	if !exists {
-		zset = &ZSET{treap: NewTreap(), elements: make(map[string]*TreapNode)}
-		ZSETs[key] = zset
+func scan(args []Value) Value {
+	if len(args) == 0 || len(args)%2 == 0 {
+		return Value{typ: "error", str: "scan wrong number of arguments"}
+	}
+	cursor, err := strconv.ParseUint(args[0].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR invalid cursor"}
 	}
-	ZSETsMu.Unlock()
 
-	zset.mu.Lock()
-	for i := 1; i < n; i += 2 {
-		score := args[i].num
-		value := args[i+1].bulk
-		if node, exists := zset.elements[value]; exists {
-			zset.treap.Erase(node.key, value)
+	pattern, typ, count := "", "", 10
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i].bulk) {
+		case "MATCH":
+			pattern = args[i+1].bulk
+		case "TYPE":
+			typ = strings.ToLower(args[i+1].bulk)
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+			if count < 1 {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	found, next := DB.Scan(cursor, count)
+	page := Value{typ: "array", array: []Value{}}
+	for _, key := range found {
+		if pattern != "" && !globMatch(pattern, key) {
+			continue
+		}
+		o := DB.Peek(key)
+		if o == nil || typ != "" && o.typ != typ {
+			continue
+		}
+		page.array = append(page.array, Value{typ: "bulk", bulk: key})
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.FormatUint(next, 10)},
+		page,
+	}}
+}
+
+// absoluteExpire turns the argument of an EX/PX/EXAT/PXAT style option or
+// of the EXPIRE family into a unix time in milliseconds. It reports false
+// when that time does not fit in an int64.
+func absoluteExpire(unit string, n int64) (int64, bool) {
+	switch unit {
+	case "EX", "EXPIRE", "EXAT", "EXPIREAT":
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return 0, false
 		}
-		node, ok := zset.treap.Insert(score, value)
-		if ok {
-			zset.elements[value] = node
+		n *= 1000
+	}
+	switch unit {
+	case "EX", "EXPIRE", "PX", "PEXPIRE":
+		now := nowMs()
+		if n > math.MaxInt64-now {
+			return 0, false
 		}
+		return now + n, true
 	}
-	zset.mu.Unlock()
+	return n, true
+}
+
+func expire(args []Value) Value {
+	return expireGeneric("EXPIRE", args)
+}
 
-	return Value{typ: "integer", num: (n - 1) / 2}
+func pexpire(args []Value) Value {
+	return expireGeneric("PEXPIRE", args)
 }
 
-func zrange(args []Value) Value {
-	n := len(args)
-	if n != 3 {
-		return Value{typ: "error", str: "zrange wrong number of arguments"}
+func expireat(args []Value) Value {
+	return expireGeneric("EXPIREAT", args)
+}
+
+func pexpireat(args []Value) Value {
+	return expireGeneric("PEXPIREAT", args)
+}
+
+func expireGeneric(command string, args []Value) Value {
+	if len(args) < 2 || len(args) > 3 {
+		return Value{typ: "error", str: strings.ToLower(command) + " wrong number of arguments"}
 	}
 	key := args[0].bulk
-	begin, _ := strconv.ParseInt(args[1].bulk, 10, 64)
-	end, _ := strconv.ParseInt(args[2].bulk, 10, 64)
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	flag := ""
+	if len(args) == 3 {
+		flag = strings.ToUpper(args[2].bulk)
+		if flag != "NX" && flag != "XX" && flag != "GT" && flag != "LT" {
+			return Value{typ: "error", str: "ERR Unsupported option " + args[2].bulk}
+		}
+	}
+	when, ok := absoluteExpire(command, n)
+	if !ok {
+		return Value{typ: "error", str: "ERR invalid expire time in '" + strings.ToLower(command) + "' command"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	if DB.Lookup(key) == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	current := DB.Expire(key)
+	switch flag {
+	case "NX":
+		if current != -1 {
+			return Value{typ: "integer", num: 0}
+		}
+	case "XX":
+		if current == -1 {
+			return Value{typ: "integer", num: 0}
+		}
+	case "GT":
+		// a key without a TTL counts as an infinite TTL
+		if current == -1 || when <= current {
+			return Value{typ: "integer", num: 0}
+		}
+	case "LT":
+		if current != -1 && when >= current {
+			return Value{typ: "integer", num: 0}
+		}
+	}
+
+	DB.SetExpire(key, when)
+	return Value{typ: "integer", num: 1}
+}
+
+// ttlGeneric returns the remaining TTL of key in milliseconds, -1 when it
+// has none and -2 when it does not exist.
+func ttlGeneric(args []Value, name string) (int64, Value, bool) {
+	if len(args) != 1 {
+		return 0, Value{typ: "error", str: name + " wrong number of arguments"}, false
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
 
-	ZSETsMu.RLock()
-	defer ZSETsMu.RUnlock()
-	zset, exists := ZSETs[key]
-	if !exists {
-		return Value{typ: "error", str: "zrange wrong"}
+	if DB.Peek(args[0].bulk) == nil {
+		return -2, Value{}, true
 	}
+	when := DB.Expire(args[0].bulk)
+	if when == -1 {
+		return -1, Value{}, true
+	}
+	return max(when-nowMs(), 0), Value{}, true
+}
 
-	zset.mu.RLock()
+func ttl(args []Value) Value {
+	ms, errValue, ok := ttlGeneric(args, "ttl")
+	if !ok {
+		return errValue
+	}
+	if ms < 0 {
+		return Value{typ: "integer", num: int(ms)}
+	}
+	return Value{typ: "integer", num: int((ms + 500) / 1000)}
+}
 
-	size := int64(zset.treap.size)
-	begin = (begin%size + size) % size
-	end = (end%size + size) % size
-	if begin > end {
-		zset.mu.RLock()
-		return Value{typ: "error", str: "zrange wrong"}
+func pttl(args []Value) Value {
+	ms, errValue, ok := ttlGeneric(args, "pttl")
+	if !ok {
+		return errValue
 	}
-	res := Value{typ: "array", array: make([]Value, 0)}
-	for i := begin + 1; i <= end+1; i++ {
-		res.array = append(res.array, Value{typ: "bulk", bulk: fmt.Sprintf("%s", zset.treap.GetNodeByRank(int(i)).value)})
+	return Value{typ: "integer", num: int(ms)}
+}
+
+func expiretimeGeneric(args []Value, name string) (int64, Value, bool) {
+	if len(args) != 1 {
+		return 0, Value{typ: "error", str: name + " wrong number of arguments"}, false
 	}
 
-	zset.mu.RUnlock()
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
 
-	return res
+	if DB.Peek(args[0].bulk) == nil {
+		return -2, Value{}, true
+	}
+	return DB.Expire(args[0].bulk), Value{}, true
 }
 
-func zrem(args []Value) Value {
-	n := len(args)
-	if n < 2 {
-		return Value{typ: "error", str: "zrem wrong number of arguments"}
+func expiretime(args []Value) Value {
+	when, errValue, ok := expiretimeGeneric(args, "expiretime")
+	if !ok {
+		return errValue
+	}
+	if when < 0 {
+		return Value{typ: "integer", num: int(when)}
+	}
+	return Value{typ: "integer", num: int(when / 1000)}
+}
+
+func pexpiretime(args []Value) Value {
+	when, errValue, ok := expiretimeGeneric(args, "pexpiretime")
+	if !ok {
+		return errValue
+	}
+	return Value{typ: "integer", num: int(when)}
+}
+
+func persist(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "persist wrong number of arguments"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	if DB.Lookup(args[0].bulk) == nil || !DB.Persist(args[0].bulk) {
+		return Value{typ: "integer", num: 0}
 	}
+	return Value{typ: "integer", num: 1}
+}
 
+// rpush and sadd are how the AOF rewrite recreates lists and sets, which
+// only enter the keyspace through a Redis RDB import.
+func rpush(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "rpush wrong number of arguments"}
+	}
 	key := args[0].bulk
-	ZSETsMu.Lock()
-	defer ZSETsMu.Unlock()
-	zset, exists := ZSETs[key]
-	if !exists {
-		return Value{typ: "error", str: "zrem wrong"}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "list")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		o = &Object{typ: "list", value: []string{}}
+		DB.Set(key, o)
 	}
+	list := o.value.([]string)
+
+	for _, arg := range args[1:] {
+		list = append(list, arg.bulk)
+		DB.Grow(o, listEntrySize(arg.bulk))
+	}
+	o.value = list
+	return Value{typ: "integer", num: len(list)}
+}
+
+func sadd(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "sadd wrong number of arguments"}
+	}
+	key := args[0].bulk
 
-	zset.mu.Lock()
-	defer zset.mu.Unlock()
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "set")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		o = &Object{typ: "set", value: map[string]struct{}{}}
+		DB.Set(key, o)
+	}
+	set := o.value.(map[string]struct{})
 
 	cnt := 0
-	for i := 1; i < n; i++ {
-		value := args[i].bulk
-		if node, exists := zset.elements[value]; exists {
-			zset.treap.Erase(node.key, value)
-			delete(zset.elements, value)
-			cnt++
+	for _, arg := range args[1:] {
+		if _, exists := set[arg.bulk]; exists {
+			continue
 		}
+		set[arg.bulk] = struct{}{}
+		DB.Grow(o, setEntrySize(arg.bulk))
+		cnt++
 	}
-
 	return Value{typ: "integer", num: cnt}
 }
 
-func zcard(args []Value) Value {
-	if len(args) != 1 {
-		return Value{typ: "error", str: "zard wrong number of arguments"}
+func hello(c *Client, args []Value) Value {
+	proto := c.proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR Protocol version is not an integer or out of range"}
+		}
+		if v != 2 && v != 3 {
+			return Value{typ: "error", str: "NOPROTO unsupported protocol version"}
+		}
+		proto = v
+	}
+
+	name := c.name
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "AUTH":
+			// there is no ACL support, so any credentials are accepted
+			if i+2 >= len(args) {
+				return Value{typ: "error", str: "ERR Syntax error in HELLO option 'auth'"}
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return Value{typ: "error", str: "ERR Syntax error in HELLO option 'setname'"}
+			}
+			i++
+			name = args[i].bulk
+		default:
+			return Value{typ: "error", str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].bulk)}
+		}
 	}
-	key := args[0].bulk
-	zset := ZSETs[key]
 
-	return Value{typ: "integer", num: zset.treap.size}
+	c.name = name
+	c.SetProto(proto)
+
+	return Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "server"}, {typ: "bulk", bulk: "redis"},
+		{typ: "bulk", bulk: "version"}, {typ: "bulk", bulk: serverVersion},
+		{typ: "bulk", bulk: "proto"}, {typ: "integer", num: proto},
+		{typ: "bulk", bulk: "id"}, {typ: "integer", num: int(c.id)},
+		{typ: "bulk", bulk: "mode"}, {typ: "bulk", bulk: "standalone"},
+		{typ: "bulk", bulk: "role"}, {typ: "bulk", bulk: "master"},
+		{typ: "bulk", bulk: "modules"}, {typ: "array", array: []Value{}},
+	}}
 }
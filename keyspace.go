@@ -0,0 +1,342 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Object is the value stored under a key. value holds a string for
+// "string", a map[string]string for "hash", a []string for "list", a
+// map[string]struct{} for "set" and a *ZSET for "zset".
+type Object struct {
+	typ   string
+	value interface{}
+	lru   int64 // last access, unix time in milliseconds
+	lfu   uint8 // logarithmic access counter
+	mem   int64 // approximate bytes used by the key and its value
+}
+
+type Keyspace struct {
+	mu      sync.RWMutex
+	data    map[string]*Object
+	expires map[string]int64 // unix time in milliseconds
+	order   *Treap           // every key ordered by keyHash, for SCAN
+	used    int64
+	ready   []string // sorted sets created while clients were blocked
+}
+
+var DB = NewKeyspace()
+
+var WrongType = Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+
+func NewKeyspace() *Keyspace {
+	return &Keyspace{data: map[string]*Object{}, expires: map[string]int64{}, order: NewTreap()}
+}
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+// Lookup returns the object stored at key, or nil, and records the access
+// for eviction. A key whose TTL has run out is deleted on the spot. The
+// caller must hold mu for writing.
+func (ks *Keyspace) Lookup(key string) *Object {
+	o := ks.Peek(key)
+	if o != nil {
+		o.touch()
+	}
+	return o
+}
+
+// Peek is Lookup without recording an access, for commands that only
+// inspect the keyspace such as TYPE, EXISTS and SCAN.
+func (ks *Keyspace) Peek(key string) *Object {
+	if when, ok := ks.expires[key]; ok && when <= nowMs() {
+		ks.Delete(key)
+		return nil
+	}
+	return ks.data[key]
+}
+
+// LookupType returns the object stored at key if it has type typ. ok is
+// false when the key exists with another type. The caller must hold mu.
+func (ks *Keyspace) LookupType(key string, typ string) (o *Object, ok bool) {
+	o = ks.Lookup(key)
+	if o == nil {
+		return nil, true
+	}
+	if o.typ != typ {
+		return nil, false
+	}
+	return o, true
+}
+
+// Set stores o at key, dropping any TTL the old value had.
+func (ks *Keyspace) Set(key string, o *Object) {
+	if old, ok := ks.data[key]; ok {
+		ks.used -= old.mem
+	} else {
+		ks.order.Insert(float64(keyHash(key)), key)
+	}
+	o.mem = objectSize(key, o)
+	o.lru = nowMs()
+	o.lfu = lfuInitVal
+	ks.used += o.mem
+
+	ks.data[key] = o
+	delete(ks.expires, key)
+	if o.typ == "zset" && blockedCount.Load() > 0 {
+		ks.ready = append(ks.ready, key)
+	}
+}
+
+func (ks *Keyspace) Delete(key string) bool {
+	o, ok := ks.data[key]
+	if !ok {
+		return false
+	}
+	ks.used -= o.mem
+	ks.order.Erase(float64(keyHash(key)), key)
+	delete(ks.data, key)
+	delete(ks.expires, key)
+	return true
+}
+
+// Grow accounts for delta bytes added to (or, when negative, removed from)
+// an object that is modified in place.
+func (ks *Keyspace) Grow(o *Object, delta int64) {
+	o.mem += delta
+	ks.used += delta
+}
+
+func (ks *Keyspace) UsedMemory() int64 {
+	return ks.used
+}
+
+// SetExpire makes key expire at the given unix time in milliseconds. A time
+// in the past deletes the key straight away.
+func (ks *Keyspace) SetExpire(key string, when int64) {
+	if _, ok := ks.data[key]; !ok {
+		return
+	}
+	if when <= nowMs() {
+		ks.Delete(key)
+		return
+	}
+	ks.expires[key] = when
+}
+
+// Expire returns the unix time in milliseconds at which key expires, or -1
+// when it has no TTL.
+func (ks *Keyspace) Expire(key string) int64 {
+	if when, ok := ks.expires[key]; ok {
+		return when
+	}
+	return -1
+}
+
+func (ks *Keyspace) Persist(key string) bool {
+	if _, ok := ks.expires[key]; !ok {
+		return false
+	}
+	delete(ks.expires, key)
+	return true
+}
+
+// Snapshot returns a point-in-time copy of every live key that can be
+// serialised without holding the lock. Strings are immutable and shared,
+// every other type is cloned.
+func (ks *Keyspace) Snapshot() []rdbEntry {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := nowMs()
+	entries := make([]rdbEntry, 0, len(ks.data))
+	for key, o := range ks.data {
+		expire := int64(-1)
+		if when, ok := ks.expires[key]; ok {
+			if when <= now {
+				continue
+			}
+			expire = when
+		}
+		entries = append(entries, rdbEntry{key: key, obj: o.clone(), expire: expire})
+	}
+	return entries
+}
+
+func (o *Object) clone() *Object {
+	c := &Object{typ: o.typ, value: o.value}
+	switch v := o.value.(type) {
+	case map[string]string:
+		fields := make(map[string]string, len(v))
+		for field, value := range v {
+			fields[field] = value
+		}
+		c.value = fields
+	case []string:
+		c.value = append([]string(nil), v...)
+	case map[string]struct{}:
+		members := make(map[string]struct{}, len(v))
+		for member := range v {
+			members[member] = struct{}{}
+		}
+		c.value = members
+	case *ZSET:
+		c.value = v.Clone()
+	}
+	return c
+}
+
+const (
+	activeExpireInterval = 100 * time.Millisecond
+	activeExpireSamples  = 20
+	activeExpireBudget   = 25 * time.Millisecond
+)
+
+// ActiveExpire reclaims expired keys that are never touched again. Every
+// interval it samples keys with a TTL and deletes the expired ones, and
+// keeps going while more than a quarter of a sample was expired and the
+// cycle's time budget lasts.
+func (ks *Keyspace) ActiveExpire() {
+	for {
+		time.Sleep(activeExpireInterval)
+
+		start := time.Now()
+		for time.Since(start) < activeExpireBudget {
+			ks.mu.Lock()
+			sampled, expired := 0, 0
+			now := nowMs()
+			for key, when := range ks.expires {
+				if sampled == activeExpireSamples {
+					break
+				}
+				sampled++
+				if when <= now {
+					ks.Delete(key)
+					expired++
+				}
+			}
+			ks.mu.Unlock()
+
+			if expired*4 <= sampled {
+				break
+			}
+		}
+	}
+}
+
+func (ks *Keyspace) Len() int {
+	return len(ks.data)
+}
+
+// Scan returns up to count keys starting at cursor, and the cursor to
+// continue from, 0 once the whole keyspace has been visited. Keys are
+// visited in the order of their hash, so a key that exists for the whole
+// iteration is returned exactly once however the keyspace changes between
+// calls. The order index makes a call cost O(log n + count).
+func (ks *Keyspace) Scan(cursor uint64, count int) ([]string, uint64) {
+	var keys []string
+	var last, next uint64
+	from := ks.order.LowerBound(float64(cursor), "")
+	ks.order.Walk(from, ks.order.size, false, func(node *TreapNode) bool {
+		hash := uint64(node.key)
+		// keys sharing a hash cannot be split across calls
+		if len(keys) >= count && hash != last {
+			next = hash
+			return false
+		}
+		keys = append(keys, node.value)
+		last = hash
+		return true
+	})
+	return keys, next
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return uint64(h.Sum32())
+}
+
+// globMatch reports whether str matches a Redis glob pattern: * ? [abc]
+// [^a-z] and backslash escapes.
+func globMatch(pattern, str string) bool {
+	p, s := 0, 0
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for i := s; i <= len(str); i++ {
+				if globMatch(pattern[p+1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == len(str) {
+				return false
+			}
+			s++
+		case '[':
+			if s == len(str) {
+				return false
+			}
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for p < len(pattern) && pattern[p] != ']' {
+				if pattern[p] == '\\' && p+1 < len(pattern) {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					lo, hi := pattern[p], pattern[p+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if str[s] >= lo && str[s] <= hi {
+						match = true
+					}
+					p += 2
+				} else if pattern[p] == str[s] {
+					match = true
+				}
+				p++
+			}
+			if p == len(pattern) {
+				// unterminated class, treat the end of the pattern as ']'
+				p--
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if s == len(str) || pattern[p] != str[s] {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+	return s == len(str)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// decodeLegacyRdb reads the unversioned snapshots of earlier releases:
+// int32 little endian counts and lengths, with a section of strings, one
+// of hashes and, in later files, one of int64 unix ms expires and one of
+// sorted sets with int64 scores. There is no magic or checksum, so the
+// whole file has to parse for it to be accepted.
+func decodeLegacyRdb(data []byte) ([]rdbEntry, error) {
+	d := &legacyDecoder{data: data}
+	var entries []rdbEntry
+
+	n, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		key, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, rdbEntry{key: key, obj: &Object{typ: "string", value: value}, expire: -1})
+	}
+
+	if n, err = d.count(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		key, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		m, err := d.count()
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]string, min(m, 1024))
+		for j := 0; j < m; j++ {
+			field, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			fields[field] = value
+		}
+		if len(fields) > 0 {
+			entries = append(entries, rdbEntry{key: key, obj: &Object{typ: "hash", value: fields}, expire: -1})
+		}
+	}
+
+	// files written before expires were saved end here
+	expires := map[string]int64{}
+	if d.pos < len(d.data) {
+		if n, err = d.count(); err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			key, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			when, err := d.int64()
+			if err != nil {
+				return nil, err
+			}
+			expires[key] = when
+		}
+	}
+
+	if d.pos < len(d.data) {
+		if n, err = d.count(); err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			key, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			m, err := d.count()
+			if err != nil {
+				return nil, err
+			}
+			members := make([]zsetEntry, 0, min(m, 1024))
+			for j := 0; j < m; j++ {
+				member, err := d.string()
+				if err != nil {
+					return nil, err
+				}
+				score, err := d.int64()
+				if err != nil {
+					return nil, err
+				}
+				members = append(members, zsetEntry{member, float64(score)})
+			}
+			if len(members) > 0 {
+				entries = append(entries, rdbEntry{key: key, obj: &Object{typ: "zset", value: zsetFromEntries(members)}, expire: -1})
+			}
+		}
+	}
+
+	if d.pos != len(d.data) {
+		return nil, &RdbError{int64(d.pos), "trailing data"}
+	}
+	for i := range entries {
+		if when, ok := expires[entries[i].key]; ok {
+			entries[i].expire = when
+		}
+	}
+	return entries, nil
+}
+
+type legacyDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *legacyDecoder) read(n int) ([]byte, error) {
+	if n > len(d.data)-d.pos {
+		return nil, &RdbError{int64(len(d.data)), "unexpected end of file"}
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *legacyDecoder) count() (int, error) {
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	n := int32(binary.LittleEndian.Uint32(b))
+	if n < 0 {
+		return 0, &RdbError{int64(d.pos - 4), "negative length"}
+	}
+	return int(n), nil
+}
+
+func (d *legacyDecoder) string() (string, error) {
+	n, err := d.count()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.read(n)
+	return string(b), err
+}
+
+func (d *legacyDecoder) int64() (int64, error) {
+	b, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
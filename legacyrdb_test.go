@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// legacySnapshot is a file saved by the baseline server after
+// SET s1 hello, SET s2 "" and HSET h f1 v1 f2 v2.
+const legacySnapshot = "\x02\x00\x00\x00\x02\x00\x00\x00s1\x05\x00\x00\x00hello\x02\x00\x00\x00s2\x00\x00\x00\x00" +
+	"\x01\x00\x00\x00\x01\x00\x00\x00h\x02\x00\x00\x00\x02\x00\x00\x00f1\x02\x00\x00\x00v1\x02\x00\x00\x00f2\x02\x00\x00\x00v2"
+
+func legacyInt(n int64, width int) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(n))[:width]
+}
+
+func legacyString(s string) []byte {
+	return append(legacyInt(int64(len(s)), 4), s...)
+}
+
+func TestDecodeLegacyRdb(t *testing.T) {
+	checkKeys(t, decodeAll(t, []byte(legacySnapshot)), map[string]string{
+		"s1": "string hello",
+		"s2": "string ",
+		"h":  "hash f1=v1,f2=v2",
+	})
+
+	// later files add expires and sorted sets with integer scores
+	d := []byte(legacySnapshot)
+	d = append(d, legacyInt(1, 4)...)
+	d = append(d, legacyString("s1")...)
+	d = append(d, legacyInt(4102444800000, 8)...)
+	d = append(d, legacyInt(1, 4)...)
+	d = append(d, legacyString("z")...)
+	d = append(d, legacyInt(2, 4)...)
+	d = append(d, legacyString("b")...)
+	d = append(d, legacyInt(2, 8)...)
+	d = append(d, legacyString("a")...)
+	d = append(d, legacyInt(-1, 8)...)
+	checkKeys(t, decodeAll(t, d), map[string]string{
+		"s1": "string hello",
+		"s2": "string ",
+		"h":  "hash f1=v1,f2=v2",
+		"z":  "zset a=-1,b=2",
+	})
+	entries, _ := decodeSnapshot(bufio.NewReader(bytes.NewReader(d)))
+	want := map[string]int64{"s1": 4102444800000, "s2": -1, "h": -1, "z": -1}
+	for _, e := range entries {
+		if e.expire != want[e.key] {
+			t.Errorf("%s: expire %d, want %d", e.key, e.expire, want[e.key])
+		}
+	}
+
+	for name, bad := range map[string][]byte{
+		"truncated": d[:len(d)-3],
+		"trailing":  append(append([]byte(nil), d...), 0),
+		"negative":  []byte("\xff\xff\xff\xff"),
+		"garbage":   []byte("garbage!"),
+	} {
+		if _, err := decodeSnapshot(bufio.NewReader(bytes.NewReader(bad))); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
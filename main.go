@@ -1,34 +1,67 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"strings"
+	"sync"
 )
 
+const port = 6380
+
+const serverVersion = "7.0.0"
+
+var writeMu sync.Mutex
+
 func main() {
-	config, err := NewConfig("redis.config")
-	if err != nil {
-		fmt.Println(err)
-		return
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check-aof":
+			os.Exit(checkAof(os.Args[2:]))
+		case "convert-rdb":
+			os.Exit(convertRdb(os.Args[2:]))
+		}
 	}
-	config.ReadConfig()
 
-	l, err := net.Listen("tcp", ":6380")
+	config, err := NewConfig("redis.config")
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	config.ReadConfig()
 
-	/*
-		aof, err := NewAof("database.aof")
+	// with appendonly the log is the more complete copy, so the snapshot
+	// is only read when the log is off or does not exist yet
+	if config.AppendOnly {
+		aof, err := NewAof("database.aof", config.AppendFsync)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 		defer aof.Close()
 
-		aof.Read(func(value Value) {
+		if aof.baseSize == 0 {
+			// appendonly was just turned on and the data is still in the
+			// snapshot: load it and write it out as the first AOF, so the
+			// log is complete and the next save does not overwrite the
+			// snapshot with an empty dataset
+			if err := RDB.Load(); err != nil {
+				fmt.Printf("Fatal error loading the DB: %v. Exiting.\n", err)
+				os.Exit(1)
+			}
+			if DB.Len() > 0 {
+				if err := aof.rewrite(DB.Snapshot(), config.RdbPreamble()); err != nil {
+					fmt.Println("Can't create the append only file from the snapshot:", err)
+					return
+				}
+			}
+		} else if err := aof.Read(func(value Value) {
+			if value.typ != "array" || len(value.array) == 0 {
+				return
+			}
 			command := strings.ToUpper(value.array[0].bulk)
 			args := value.array[1:]
 
@@ -38,47 +71,128 @@ func main() {
 				return
 			}
 			handler(args)
-		})
-	*/
+		}, config.AofLoadTruncated); err != nil {
+			fmt.Println("Bad file format reading the append only file:", err)
+			fmt.Println("Make a backup of database.aof and run check-aof --fix on it to repair it")
+			return
+		}
+		AOF = aof
+		go AOF.Cron(config)
+	} else if err := RDB.Load(); err != nil {
+		// starting empty would let the next save overwrite the only copy
+		fmt.Printf("Fatal error loading the DB: %v. Exiting.\n", err)
+		os.Exit(1)
+	}
 
-	rdb, err := NewRdb("database.rdb")
-	rdb.Load()
+	go DB.ActiveExpire()
+	go RDB.Cron(config)
 
-	conn, err := l.Accept()
+	if config.IoMode == "epoll" {
+		if err := ServeEpoll(port); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	defer conn.Close()
 
 	for {
-		resp := NewResp(conn)
-		value, err := resp.Read()
+		conn, err := l.Accept()
 		if err != nil {
 			fmt.Println(err)
+			continue
+		}
+		go handleConn(NewClient(conn))
+	}
+}
+
+func handleConn(c *Client) {
+	defer c.Close()
+
+	for {
+		value, err := c.resp.ReadCommand()
+		if err != nil {
+			var perr *ProtocolError
+			if errors.As(err, &perr) {
+				c.writer.Write(Value{typ: "error", str: "ERR " + perr.Error()})
+			}
+			if err != io.EOF {
+				fmt.Println(err)
+			}
 			return
 		}
-		if value.typ != "array" {
+		if value.typ != "array" || len(value.array) == 0 {
 			fmt.Println("Invalid type:", value.typ)
-			continue
+			c.writer.Write(Value{typ: "error", str: "ERR Protocol error: expected array"})
+			return
 		}
 
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
+		result := dispatch(c, value)
+		if err := c.writer.Write(result); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+}
 
-		writer := NewWrite(conn)
-		handler, ok := Handler[command]
-		if !ok {
-			fmt.Println("Invalid command:", command)
-			writer.Write(Value{typ: "string", str: ""})
-			continue
+func dispatch(c *Client, value Value) Value {
+	command := strings.ToUpper(value.array[0].bulk)
+	args := value.array[1:]
+
+	if handler, ok := ClientHandler[command]; ok {
+		return handler(c, args)
+	}
+
+	handler, ok := Handler[command]
+	if !ok {
+		fmt.Println("Invalid command:", command)
+		return Value{typ: "string", str: ""}
+	}
+
+	if commandFlags[command]&cmdWrite == 0 {
+		return handler(args)
+	}
+
+	// writes run one at a time so the log records them in the order
+	// they were applied
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if maxmemory, policy, samples := instance.Eviction(); maxmemory > 0 {
+		DB.mu.Lock()
+		victims, ok := DB.Evict(maxmemory, policy, samples)
+		DB.mu.Unlock()
+		// evicted keys are deleted on replay too
+		for _, key := range victims {
+			propagate(Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: "DEL"},
+				{typ: "bulk", bulk: key},
+			}})
+		}
+		if !ok && commandFlags[command]&cmdDenyOOM != 0 {
+			return Value{typ: "error", str: oomErrMessage}
 		}
+	}
 
-		//if command == "SET" || command == "HSET" {
-		//	aof.Write(value)
-		//}
+	result := handler(args)
+	if result.typ != "error" {
+		propagate(value)
+		serveBlocked()
+	}
+	return result
+}
 
-		result := handler(args)
-		writer.Write(result)
+// propagate counts a write towards the save rules and appends it to the
+// AOF. The caller must hold writeMu.
+func propagate(command Value) {
+	RDB.Dirty(1)
+	if AOF != nil {
+		if err := AOF.Write(aofCommand(command)); err != nil {
+			fmt.Println("aof write failed:", err)
+		}
 	}
 }
@@ -1,35 +1,224 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// An RDB file is the magic "LREDIS", a uint16 format version and a list of
+// records, each introduced by a one byte opcode. Strings are written as a
+// uvarint length followed by the bytes. The file ends with rdbOpEOF and
+// the CRC-64 of everything before the checksum.
+const (
+	rdbMagic   = "LREDIS"
+	rdbVersion = 2
+
+	rdbOpString = 0x00 // key, value
+	rdbOpList   = 0x01 // key, element count, elements (version 2)
+	rdbOpSet    = 0x02 // key, member count, members (version 2)
+	rdbOpHash   = 0x04 // key, field count, fields and values
+	rdbOpZSet   = 0x05 // key, member count, members and float64 scores
+	rdbOpAux    = 0xFA // name, value
+	rdbOpExpire = 0xFC // int64 unix ms, applies to the next key
+	rdbOpEOF    = 0xFF
+)
+
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Jones continues a CRC-64/Jones checksum, the variant Redis uses,
+// which unlike hash/crc64 does not invert the register.
+func crc64Jones(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
+
+// RdbError reports a corrupt or truncated RDB file and where the problem
+// was found.
+type RdbError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *RdbError) Error() string {
+	return fmt.Sprintf("rdb: %s at offset %d", e.Msg, e.Offset)
+}
+
 type Rdb struct {
-	file *os.File
-	mu   sync.RWMutex
+	path string
+	mu   sync.Mutex // serialises access to the file
+
+	statusMu     sync.Mutex
+	saving       bool
+	saveStart    time.Time
+	lastSave     time.Time
+	lastErr      error
+	lastDuration time.Duration
+	saves        int
+	lastTry      time.Time
+	keysTotal    int
+	keysWritten  atomic.Int64
+
+	// dirty counts writes since the last successful save, dirtyAtStart the
+	// part of them the running save covers.
+	dirty        atomic.Int64
+	dirtyAtStart int64
 }
 
-func NewRdb(path string) (*Rdb, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
-	rdb := &Rdb{file: file}
+// bgsaveRetryDelay keeps a failing automatic save from being retried in a
+// tight loop.
+const bgsaveRetryDelay = 5 * time.Second
 
-	return rdb, err
+var RDB = NewRdb("database.rdb")
+
+var ErrSaveInProgress = errors.New("Background save already in progress")
+
+func NewRdb(path string) *Rdb {
+	return &Rdb{path: path, lastSave: time.Now()}
 }
 
+// Save writes a snapshot on the calling goroutine.
 func (r *Rdb) Save() error {
+	entries, err := r.begin()
+	if err != nil {
+		return err
+	}
+	err = r.write(entries)
+	r.end(err)
+	return err
+}
 
-	// save string map[string]string
-	sets, err := r.saveSETS()
+// BgSave copies the keyspace while holding its lock, which is quick next
+// to serialising it, and writes that point-in-time copy on another
+// goroutine so clients keep running.
+func (r *Rdb) BgSave() error {
+	entries, err := r.begin()
 	if err != nil {
 		return err
 	}
+	go func() {
+		r.end(r.write(entries))
+	}()
+	return nil
+}
+
+func (r *Rdb) begin() ([]rdbEntry, error) {
+	// holding writeMu keeps writes out between the snapshot and reading
+	// dirty, so dirtyAtStart counts exactly the writes the snapshot holds
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
 
-	// save hash map[string]map[string]string
-	hsets, err := r.saveHSETS()
+	if r.saving {
+		return nil, ErrSaveInProgress
+	}
+	entries := DB.Snapshot()
+	r.saving = true
+	r.saveStart = time.Now()
+	r.lastTry = r.saveStart
+	r.dirtyAtStart = r.dirty.Load()
+	r.keysTotal = len(entries)
+	r.keysWritten.Store(0)
+	return entries, nil
+}
+
+func (r *Rdb) end(err error) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	r.saving = false
+	r.lastErr = err
+	r.lastDuration = time.Since(r.saveStart)
+	if err == nil {
+		r.lastSave = r.saveStart
+		r.saves++
+		r.dirty.Add(-r.dirtyAtStart)
+	} else {
+		fmt.Println("rdb save failed:", err)
+	}
+}
+
+func (r *Rdb) LastSave() time.Time {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.lastSave
+}
+
+// Info returns the rdb_* fields of INFO persistence.
+func (r *Rdb) Info() string {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	status := "ok"
+	if r.lastErr != nil {
+		status = "err"
+	}
+	inProgress, current := 0, int64(-1)
+	if r.saving {
+		inProgress = 1
+		current = int64(time.Since(r.saveStart).Seconds())
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "rdb_changes_since_last_save:%d\r\n", r.dirty.Load())
+	fmt.Fprintf(&b, "rdb_bgsave_in_progress:%d\r\n", inProgress)
+	fmt.Fprintf(&b, "rdb_last_save_time:%d\r\n", r.lastSave.Unix())
+	fmt.Fprintf(&b, "rdb_last_bgsave_status:%s\r\n", status)
+	fmt.Fprintf(&b, "rdb_last_bgsave_time_sec:%d\r\n", int64(r.lastDuration.Seconds()))
+	fmt.Fprintf(&b, "rdb_current_bgsave_time_sec:%d\r\n", current)
+	fmt.Fprintf(&b, "rdb_current_bgsave_keys_total:%d\r\n", r.keysTotal)
+	fmt.Fprintf(&b, "rdb_current_bgsave_keys_written:%d\r\n", r.keysWritten.Load())
+	fmt.Fprintf(&b, "rdb_saves:%d\r\n", r.saves)
+	return b.String()
+}
+
+// Dirty records n writes to the keyspace.
+func (r *Rdb) Dirty(n int64) {
+	r.dirty.Add(n)
+}
+
+// Cron starts a background save whenever one of the save rules is met:
+// at least Changes writes and Seconds seconds since the last save.
+func (r *Rdb) Cron(config *Config) {
+	for {
+		time.Sleep(time.Second)
+
+		r.statusMu.Lock()
+		saving, lastSave, lastErr, lastTry := r.saving, r.lastSave, r.lastErr, r.lastTry
+		r.statusMu.Unlock()
+		if saving || lastErr != nil && time.Since(lastTry) < bgsaveRetryDelay {
+			continue
+		}
+
+		dirty := r.dirty.Load()
+		for _, rule := range config.SaveRules() {
+			if dirty >= int64(rule.Changes) && dirty > 0 && time.Since(lastSave) >= time.Duration(rule.Seconds)*time.Second {
+				fmt.Printf("%d changes in %d seconds. Saving...\n", rule.Changes, rule.Seconds)
+				if err := r.BgSave(); err != nil {
+					fmt.Println(err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// write stores entries in a temporary file in the same directory and
+// renames it over the old snapshot once it is safely on disk, so a crash
+// at any point leaves either the old or the new snapshot intact.
+func (r *Rdb) write(entries []rdbEntry) error {
+	data, err := r.encode(entries)
 	if err != nil {
 		return err
 	}
@@ -37,213 +226,479 @@ func (r *Rdb) Save() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.file.Truncate(0)
-	r.file.Write(sets)
-	r.file.Write(hsets)
-	r.file.Sync()
+	dir := filepath.Dir(r.path)
+	tmp, err := createTemp(r.path, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
 
-	return nil
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return err
+	}
+	return syncDir(dir)
 }
 
-func (r *Rdb) Load() error {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	data, err := io.ReadAll(r.file)
+// createTemp creates the file that a new version of path is written to
+// before it is renamed over path. Unlike os.CreateTemp, which makes files
+// only their owner can read, it leaves the permissions to the umask the way
+// creating path would, and keeps those of path when it exists.
+func createTemp(path, name string) (*os.File, error) {
+	tmp, err := os.OpenFile(filepath.Join(filepath.Dir(path), name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if info, err := os.Stat(path); err == nil {
+		if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	return tmp, nil
+}
 
-	n, err := r.loadSETS(data)
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
-	data = data[n:]
+	defer d.Close()
+	return d.Sync()
+}
 
-	n, err = r.loadHSETS(data)
+// Load reads the whole file before touching the keyspace, so a corrupt
+// file is rejected without loading any of it. A missing file is an empty
+// dataset. A snapshot in the legacy layout is saved again right away, so
+// it gets a version and a checksum.
+func (r *Rdb) Load() error {
+	entries, legacy, err := r.read()
 	if err != nil {
 		return err
 	}
-	data = data[n:]
-
+	loadEntries(entries)
+	if legacy {
+		fmt.Printf("Converting %s from the legacy snapshot layout\n", r.path)
+		return r.write(DB.Snapshot())
+	}
 	return nil
 }
 
-func (r *Rdb) Close() error {
+func (r *Rdb) read() (entries []rdbEntry, legacy bool, err error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.file.Close()
-}
 
-func (r *Rdb) saveSETS() ([]byte, error) {
-	var buffer bytes.Buffer
-	SETsMu.RLock()
-	defer SETsMu.RUnlock()
+	file, err := os.Open(r.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer file.Close()
 
-	setSize := int32(len(SETs))
-	if err := binary.Write(&buffer, binary.LittleEndian, setSize); err != nil {
-		return nil, err
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Size() == 0 {
+		return nil, false, nil
 	}
 
-	for key, val := range SETs {
-		keyLength := int32(len(key))
-		if err := binary.Write(&buffer, binary.LittleEndian, keyLength); err != nil {
-			return nil, err
-		}
-		if err := binary.Write(&buffer, binary.LittleEndian, []byte(key)); err != nil {
-			return nil, err
-		}
+	reader := bufio.NewReader(file)
+	legacy = !hasSnapshot(reader)
+	entries, err = decodeSnapshot(reader)
+	return entries, legacy, err
+}
 
-		valLength := int32(len(val))
-		if err := binary.Write(&buffer, binary.LittleEndian, valLength); err != nil {
-			return nil, err
+func loadEntries(entries []rdbEntry) {
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	for _, e := range entries {
+		DB.Set(e.key, e.obj)
+		if e.expire != -1 {
+			// keys that expired while the server was down are dropped here
+			DB.SetExpire(e.key, e.expire)
 		}
-		if err := binary.Write(&buffer, binary.LittleEndian, []byte(val)); err != nil {
-			return nil, err
+	}
+}
+
+type rdbEntry struct {
+	key    string
+	obj    *Object
+	expire int64
+}
+
+func (r *Rdb) encode(entries []rdbEntry) ([]byte, error) {
+	encode := encodeRdb
+	if instance.SnapshotFormat() == "redis" {
+		encode = encodeRedisRdb
+	}
+
+	var buffer bytes.Buffer
+	err := encode(&buffer, entries, &r.keysWritten)
+	return buffer.Bytes(), err
+}
+
+// encodeRdb writes entries to w as a complete RDB file, counting the keys
+// written in progress.
+func encodeRdb(w io.Writer, entries []rdbEntry, progress *atomic.Int64) error {
+	enc := &rdbEncoder{w: w}
+
+	enc.header()
+	enc.aux("ctime", fmt.Sprint(time.Now().Unix()))
+
+	for _, e := range entries {
+		if e.expire != -1 {
+			enc.opcode(rdbOpExpire)
+			enc.int64(e.expire)
 		}
+		enc.object(e.key, e.obj)
+		progress.Add(1)
 	}
 
-	return buffer.Bytes(), nil
+	enc.footer()
+	return enc.err
 }
 
-func (r *Rdb) loadSETS(data []byte) (int32, error) {
-	buffer := bytes.NewBuffer(data)
-	n := int32(0)
+type rdbEncoder struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
 
-	var setSize int32
-	if err := binary.Read(buffer, binary.LittleEndian, &setSize); err != nil {
-		return 0, err
+func (e *rdbEncoder) write(p []byte) {
+	if e.err != nil {
+		return
 	}
-	n += 4
+	e.crc = crc64Jones(e.crc, p)
+	_, e.err = e.w.Write(p)
+}
 
-	for i := int32(0); i < setSize; i++ {
-		var keyLength int32
-		var valLength int32
+func (e *rdbEncoder) header() {
+	e.write([]byte(rdbMagic))
+	e.write(binary.LittleEndian.AppendUint16(nil, rdbVersion))
+}
 
-		if err := binary.Read(buffer, binary.LittleEndian, &keyLength); err != nil {
-			return 0, err
+func (e *rdbEncoder) footer() {
+	e.opcode(rdbOpEOF)
+	if e.err == nil {
+		_, e.err = e.w.Write(binary.LittleEndian.AppendUint64(nil, e.crc))
+	}
+}
+
+func (e *rdbEncoder) opcode(op byte) {
+	e.write([]byte{op})
+}
+
+func (e *rdbEncoder) length(n int) {
+	e.write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (e *rdbEncoder) string(s string) {
+	e.length(len(s))
+	e.write([]byte(s))
+}
+
+func (e *rdbEncoder) int64(n int64) {
+	e.write(binary.LittleEndian.AppendUint64(nil, uint64(n)))
+}
+
+func (e *rdbEncoder) float64(f float64) {
+	e.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(f)))
+}
+
+func (e *rdbEncoder) aux(name, value string) {
+	e.opcode(rdbOpAux)
+	e.string(name)
+	e.string(value)
+}
+
+func (e *rdbEncoder) object(key string, o *Object) {
+	switch v := o.value.(type) {
+	case string:
+		e.opcode(rdbOpString)
+		e.string(key)
+		e.string(v)
+	case map[string]string:
+		e.opcode(rdbOpHash)
+		e.string(key)
+		e.length(len(v))
+		for field, value := range v {
+			e.string(field)
+			e.string(value)
 		}
-		n += 4
-		key := make([]byte, keyLength)
-		if err := binary.Read(buffer, binary.LittleEndian, &key); err != nil {
-			return 0, err
+	case []string:
+		e.opcode(rdbOpList)
+		e.string(key)
+		e.length(len(v))
+		for _, elem := range v {
+			e.string(elem)
+		}
+	case map[string]struct{}:
+		e.opcode(rdbOpSet)
+		e.string(key)
+		e.length(len(v))
+		for member := range v {
+			e.string(member)
 		}
-		n += keyLength
+	case *ZSET:
+		e.opcode(rdbOpZSet)
+		e.string(key)
+		e.length(len(v.elements))
+		// in order, so loading can build the treap without sorting
+		v.treap.Each(func(node *TreapNode) {
+			e.string(node.value)
+			e.float64(node.key)
+		})
+	}
+}
 
-		if err := binary.Read(buffer, binary.LittleEndian, &valLength); err != nil {
-			return 0, err
+// hasSnapshot reports whether reader starts with an RDB file in our format
+// or in the one written by Redis.
+func hasSnapshot(reader *bufio.Reader) bool {
+	magic, _ := reader.Peek(len(rdbMagic))
+	return string(magic) == rdbMagic || strings.HasPrefix(string(magic), redisRdbMagic)
+}
+
+// decodeSnapshot reads an RDB file in either format, or in the legacy
+// layout that came before them.
+func decodeSnapshot(reader *bufio.Reader) ([]rdbEntry, error) {
+	if !hasSnapshot(reader) {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
 		}
-		n += 4
-		val := make([]byte, valLength)
-		if err := binary.Read(buffer, binary.LittleEndian, &val); err != nil {
-			return 0, err
+		entries, err := decodeLegacyRdb(data)
+		if err != nil {
+			return nil, &RdbError{0, "not an rdb file, bad magic"}
 		}
-		n += valLength
-
-		SETsMu.Lock()
-		SETs[string(key)] = string(val)
-		SETsMu.Unlock()
+		return entries, nil
+	}
+	if magic, _ := reader.Peek(len(redisRdbMagic)); string(magic) == redisRdbMagic {
+		return decodeRedisRdb(reader)
 	}
-	return n, nil
+	return decodeRdb(reader)
 }
 
-func (r *Rdb) saveHSETS() ([]byte, error) {
-	var buffer bytes.Buffer
-	SETsMu.RLock()
-	defer SETsMu.RUnlock()
+type rdbDecoder struct {
+	r      *bufio.Reader
+	offset int64
+	crc    uint64
+}
+
+func decodeRdb(reader *bufio.Reader) ([]rdbEntry, error) {
+	d := &rdbDecoder{r: reader}
 
-	hsetSize := int32(len(HSETs))
-	if err := binary.Write(&buffer, binary.LittleEndian, hsetSize); err != nil {
+	magic, err := d.read(len(rdbMagic))
+	if err != nil {
 		return nil, err
 	}
-	for hkey, hval := range HSETs {
-		hkeyLength := int32(len(hkey))
-		if err := binary.Write(&buffer, binary.LittleEndian, hkeyLength); err != nil {
-			return nil, err
-		}
-		if err := binary.Write(&buffer, binary.LittleEndian, []byte(hkey)); err != nil {
-			return nil, err
-		}
-		hvalLength := int32(len(hval))
-		if err := binary.Write(&buffer, binary.LittleEndian, hvalLength); err != nil {
+	if string(magic) != rdbMagic {
+		return nil, &RdbError{0, "not an rdb file, bad magic"}
+	}
+	version, err := d.read(2)
+	if err != nil {
+		return nil, err
+	}
+	if v := binary.LittleEndian.Uint16(version); v == 0 || v > rdbVersion {
+		return nil, &RdbError{int64(len(rdbMagic)), fmt.Sprintf("unsupported version %d", v)}
+	}
+
+	var entries []rdbEntry
+	expire := int64(-1)
+	for {
+		start := d.offset
+		op, err := d.read(1)
+		if err != nil {
 			return nil, err
 		}
-		for key, val := range hval {
-			keyLength := int32(len(key))
-			if err := binary.Write(&buffer, binary.LittleEndian, keyLength); err != nil {
+
+		switch op[0] {
+		case rdbOpEOF:
+			computed := d.crc
+			sum, err := d.read(8)
+			if err != nil {
 				return nil, err
 			}
-			if err := binary.Write(&buffer, binary.LittleEndian, []byte(key)); err != nil {
+			if stored := binary.LittleEndian.Uint64(sum); stored != computed {
+				return nil, &RdbError{start + 1, fmt.Sprintf("checksum mismatch, file has %016x, computed %016x", stored, computed)}
+			}
+			return entries, nil
+		case rdbOpAux:
+			if _, err := d.string(); err != nil {
 				return nil, err
 			}
-			valLength := int32(len(val))
-			if err := binary.Write(&buffer, binary.LittleEndian, valLength); err != nil {
+			if _, err := d.string(); err != nil {
 				return nil, err
 			}
-			if err := binary.Write(&buffer, binary.LittleEndian, []byte(val)); err != nil {
+		case rdbOpExpire:
+			if expire, err = d.int64(); err != nil {
 				return nil, err
 			}
+		case rdbOpString, rdbOpList, rdbOpSet, rdbOpHash, rdbOpZSet:
+			key, obj, err := d.object(op[0])
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, rdbEntry{key: key, obj: obj, expire: expire})
+			expire = -1
+		default:
+			return nil, &RdbError{start, fmt.Sprintf("unknown opcode 0x%02x", op[0])}
 		}
 	}
-	return buffer.Bytes(), nil
 }
 
-func (r *Rdb) loadHSETS(data []byte) (int32, error) {
-	buffer := bytes.NewBuffer(data)
-	n := int32(0)
-
-	var hsetSize int32
-	if err := binary.Read(buffer, binary.LittleEndian, &hsetSize); err != nil {
-		return 0, err
+func (d *rdbDecoder) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	read, err := io.ReadFull(d.r, buf)
+	d.crc = crc64Jones(d.crc, buf[:read])
+	d.offset += int64(read)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, &RdbError{d.offset, "unexpected end of file"}
 	}
-	n += 4
+	return buf, err
+}
 
-	for i := int32(0); i < hsetSize; i++ {
-		var hKeyLength int32
-		if err := binary.Read(buffer, binary.LittleEndian, &hKeyLength); err != nil {
+func (d *rdbDecoder) length() (int, error) {
+	start := d.offset
+	var n uint64
+	for shift := 0; ; shift += 7 {
+		b, err := d.read(1)
+		if err != nil {
 			return 0, err
 		}
-		n += 4
-
-		hkey := make([]byte, hKeyLength)
-		if err := binary.Read(buffer, binary.LittleEndian, &hkey); err != nil {
-			return 0, err
+		if shift > 63 {
+			return 0, &RdbError{start, "invalid length"}
+		}
+		n |= uint64(b[0]&0x7f) << shift
+		if b[0] < 0x80 {
+			break
 		}
-		n += hKeyLength
+	}
+	if n > maxBulkLen {
+		return 0, &RdbError{start, fmt.Sprintf("length %d out of range", n)}
+	}
+	return int(n), nil
+}
 
-		var hvalLength int32
-		if err := binary.Read(buffer, binary.LittleEndian, &hvalLength); err != nil {
-			return 0, err
+func (d *rdbDecoder) string() (string, error) {
+	n, err := d.length()
+	if err != nil {
+		return "", err
+	}
+	buf, err := d.read(n)
+	return string(buf), err
+}
+
+func (d *rdbDecoder) int64() (int64, error) {
+	buf, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func (d *rdbDecoder) float64() (float64, error) {
+	buf, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func (d *rdbDecoder) object(op byte) (string, *Object, error) {
+	key, err := d.string()
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch op {
+	case rdbOpString:
+		value, err := d.string()
+		if err != nil {
+			return "", nil, err
+		}
+		return key, &Object{typ: "string", value: value}, nil
+	case rdbOpHash:
+		n, err := d.length()
+		if err != nil {
+			return "", nil, err
 		}
-		n += 4
-		for i := int32(0); i < hvalLength; i++ {
-			var keyLength int32
-			var valLength int32
-			if err := binary.Read(buffer, binary.LittleEndian, &keyLength); err != nil {
-				return 0, err
+		fields := make(map[string]string, min(n, 1024))
+		for i := 0; i < n; i++ {
+			field, err := d.string()
+			if err != nil {
+				return "", nil, err
 			}
-			n += 4
-
-			key := make([]byte, keyLength)
-			if err := binary.Read(buffer, binary.LittleEndian, &key); err != nil {
-				return 0, err
+			value, err := d.string()
+			if err != nil {
+				return "", nil, err
+			}
+			fields[field] = value
+		}
+		return key, &Object{typ: "hash", value: fields}, nil
+	case rdbOpList:
+		n, err := d.length()
+		if err != nil {
+			return "", nil, err
+		}
+		list := make([]string, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			elem, err := d.string()
+			if err != nil {
+				return "", nil, err
 			}
-			n += keyLength
-			if err := binary.Read(buffer, binary.LittleEndian, &valLength); err != nil {
-				return 0, err
+			list = append(list, elem)
+		}
+		return key, &Object{typ: "list", value: list}, nil
+	case rdbOpSet:
+		n, err := d.length()
+		if err != nil {
+			return "", nil, err
+		}
+		set := make(map[string]struct{}, min(n, 1024))
+		for i := 0; i < n; i++ {
+			member, err := d.string()
+			if err != nil {
+				return "", nil, err
+			}
+			set[member] = struct{}{}
+		}
+		return key, &Object{typ: "set", value: set}, nil
+	default:
+		n, err := d.length()
+		if err != nil {
+			return "", nil, err
+		}
+		entries := make([]zsetEntry, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			member, err := d.string()
+			if err != nil {
+				return "", nil, err
 			}
-			n += 4
-			val := make([]byte, valLength)
-			if err := binary.Read(buffer, binary.LittleEndian, &val); err != nil {
-				return 0, err
+			score, err := d.float64()
+			if err != nil {
+				return "", nil, err
 			}
-			n += valLength
-			HSETsMu.Lock()
-			if _, ok := HSETs[string(hkey)]; !ok {
-				HSETs[string(hkey)] = map[string]string{}
+			if math.IsNaN(score) {
+				return "", nil, &RdbError{d.offset - 8, "nan score"}
 			}
-			HSETs[string(hkey)][string(key)] = string(val)
-			HSETsMu.Unlock()
+			entries = append(entries, zsetEntry{member, score})
 		}
+		return key, &Object{typ: "zset", value: zsetFromEntries(entries)}, nil
 	}
-	return n, nil
 }
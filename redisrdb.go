@@ -0,0 +1,825 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The RDB format of Redis itself: the magic "REDIS", a four digit version
+// and records introduced by an object type or an opcode. Lengths use the
+// 6/14/32/64 bit encoding, strings may be stored as integers or LZF
+// compressed, and small collections as ziplists, listpacks or intsets
+// nested in a string. Dumps up to version 12 are read; snapshots are
+// written as version 9 with plain encodings, which Redis 5 and later load.
+// The expire, aux and EOF opcodes and the trailing CRC-64 are the same as
+// in our own format.
+const (
+	redisRdbMagic      = "REDIS"
+	redisRdbVersion    = 9
+	redisRdbMaxVersion = 12
+
+	redisRdbTypeString        = 0
+	redisRdbTypeList          = 1
+	redisRdbTypeSet           = 2
+	redisRdbTypeZSet          = 3 // scores as strings
+	redisRdbTypeHash          = 4
+	redisRdbTypeZSet2         = 5 // scores as binary doubles
+	redisRdbTypeListZiplist   = 10
+	redisRdbTypeSetIntset     = 11
+	redisRdbTypeZSetZiplist   = 12
+	redisRdbTypeHashZiplist   = 13
+	redisRdbTypeListQuicklist = 14
+	redisRdbTypeHashListpack  = 16
+	redisRdbTypeZSetListpack  = 17
+	redisRdbTypeListQuick2    = 18
+	redisRdbTypeSetListpack   = 20
+
+	redisRdbOpFunction2 = 0xF5
+	redisRdbOpModuleAux = 0xF7
+	redisRdbOpIdle      = 0xF8
+	redisRdbOpFreq      = 0xF9
+	redisRdbOpResizeDB  = 0xFB
+	redisRdbOpExpireSec = 0xFD
+	redisRdbOpSelectDB  = 0xFE
+
+	redisRdbEncInt8  = 0
+	redisRdbEncInt16 = 1
+	redisRdbEncInt32 = 2
+	redisRdbEncLzf   = 3
+
+	quicklistNodePlain = 1
+)
+
+func decodeRedisRdb(reader *bufio.Reader) ([]rdbEntry, error) {
+	d := &rdbDecoder{r: reader}
+
+	header, err := d.read(len(redisRdbMagic) + 4)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(redisRdbMagic)]) != redisRdbMagic {
+		return nil, &RdbError{0, "not a redis rdb file, bad magic"}
+	}
+	version, err := strconv.Atoi(string(header[len(redisRdbMagic):]))
+	if err != nil || version < 1 || version > redisRdbMaxVersion {
+		return nil, &RdbError{int64(len(redisRdbMagic)), fmt.Sprintf("unsupported version %q", header[len(redisRdbMagic):])}
+	}
+
+	var entries []rdbEntry
+	expire := int64(-1)
+	db, skipped := 0, 0
+	for {
+		start := d.offset
+		op, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op[0] {
+		case rdbOpEOF:
+			if skipped > 0 {
+				fmt.Printf("rdb: skipped %d keys outside database 0\n", skipped)
+			}
+			if version < 5 {
+				return entries, nil
+			}
+			computed := d.crc
+			sum, err := d.read(8)
+			if err != nil {
+				return nil, err
+			}
+			// a zero checksum means the dump was written with rdbchecksum no
+			if stored := binary.LittleEndian.Uint64(sum); stored != 0 && stored != computed {
+				return nil, &RdbError{start + 1, fmt.Sprintf("checksum mismatch, file has %016x, computed %016x", stored, computed)}
+			}
+			return entries, nil
+		case rdbOpAux:
+			if _, err := d.redisString(); err != nil {
+				return nil, err
+			}
+			if _, err := d.redisString(); err != nil {
+				return nil, err
+			}
+		case redisRdbOpSelectDB:
+			if db, err = d.redisCount(); err != nil {
+				return nil, err
+			}
+		case redisRdbOpResizeDB:
+			if _, err := d.redisCount(); err != nil {
+				return nil, err
+			}
+			if _, err := d.redisCount(); err != nil {
+				return nil, err
+			}
+		case rdbOpExpire:
+			if expire, err = d.int64(); err != nil {
+				return nil, err
+			}
+		case redisRdbOpExpireSec:
+			buf, err := d.read(4)
+			if err != nil {
+				return nil, err
+			}
+			expire = int64(binary.LittleEndian.Uint32(buf)) * 1000
+		case redisRdbOpIdle:
+			if _, err := d.redisCount(); err != nil {
+				return nil, err
+			}
+		case redisRdbOpFreq:
+			if _, err := d.read(1); err != nil {
+				return nil, err
+			}
+		case redisRdbOpFunction2:
+			// functions have no equivalent here, skip their code
+			if _, err := d.redisString(); err != nil {
+				return nil, err
+			}
+		case redisRdbOpModuleAux:
+			return nil, &RdbError{start, "module data is not supported"}
+		default:
+			key, obj, err := d.redisObject(op[0], start)
+			if err != nil {
+				return nil, err
+			}
+			if db == 0 {
+				entries = append(entries, rdbEntry{key: key, obj: obj, expire: expire})
+			} else {
+				skipped++
+			}
+			expire = -1
+		}
+	}
+}
+
+// redisLength reads a length. When encoded is true the string that follows
+// is stored in the special encoding n instead.
+func (d *rdbDecoder) redisLength() (n uint64, encoded bool, err error) {
+	start := d.offset
+	b, err := d.read(1)
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b[0] >> 6 {
+	case 0:
+		return uint64(b[0] & 0x3f), false, nil
+	case 1:
+		next, err := d.read(1)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b[0]&0x3f)<<8 | uint64(next[0]), false, nil
+	case 2:
+		switch b[0] {
+		case 0x80:
+			buf, err := d.read(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := d.read(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		}
+		return 0, false, &RdbError{start, fmt.Sprintf("invalid length encoding 0x%02x", b[0])}
+	default:
+		return uint64(b[0] & 0x3f), true, nil
+	}
+}
+
+// redisCount reads a plain length, such as the number of elements of a
+// collection.
+func (d *rdbDecoder) redisCount() (int, error) {
+	start := d.offset
+	n, encoded, err := d.redisLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded || n > maxBulkLen {
+		return 0, &RdbError{start, "invalid length"}
+	}
+	return int(n), nil
+}
+
+func (d *rdbDecoder) redisString() (string, error) {
+	start := d.offset
+	n, encoded, err := d.redisLength()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		if n > maxBulkLen {
+			return "", &RdbError{start, fmt.Sprintf("length %d out of range", n)}
+		}
+		buf, err := d.read(int(n))
+		return string(buf), err
+	}
+
+	switch n {
+	case redisRdbEncInt8:
+		buf, err := d.read(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(buf[0]))), nil
+	case redisRdbEncInt16:
+		buf, err := d.read(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case redisRdbEncInt32:
+		buf, err := d.read(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case redisRdbEncLzf:
+		clen, err := d.redisCount()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := d.redisCount()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := d.read(clen)
+		if err != nil {
+			return "", err
+		}
+		buf, err := lzfDecompress(compressed, ulen)
+		if err != nil {
+			return "", &RdbError{start, err.Error()}
+		}
+		return string(buf), nil
+	}
+	return "", &RdbError{start, fmt.Sprintf("unknown string encoding %d", n)}
+}
+
+// redisScore reads a score of the original sorted set type: a length byte
+// with 253, 254 and 255 standing for nan, +inf and -inf, then the number
+// as text.
+func (d *rdbDecoder) redisScore() (float64, error) {
+	start := d.offset
+	b, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	switch b[0] {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := d.read(int(b[0]))
+	if err != nil {
+		return 0, err
+	}
+	score, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil {
+		return 0, &RdbError{start, fmt.Sprintf("invalid score %q", buf)}
+	}
+	return score, nil
+}
+
+// redisStrings reads a collection stored as a count followed by that many
+// strings, or pairs of strings when width is 2.
+func (d *rdbDecoder) redisStrings(width int) ([]string, error) {
+	n, err := d.redisCount()
+	if err != nil {
+		return nil, err
+	}
+	elems := make([]string, 0, min(n*width, 1024))
+	for i := 0; i < n*width; i++ {
+		elem, err := d.redisString()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+// redisEncoded reads a string holding a compact encoding and decodes it
+// with decode.
+func (d *rdbDecoder) redisEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	start := d.offset
+	data, err := d.redisString()
+	if err != nil {
+		return nil, err
+	}
+	elems, err := decode([]byte(data))
+	if err != nil {
+		return nil, &RdbError{start, err.Error()}
+	}
+	return elems, nil
+}
+
+func (d *rdbDecoder) redisObject(typ byte, start int64) (string, *Object, error) {
+	key, err := d.redisString()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var elems []string
+	switch typ {
+	case redisRdbTypeString:
+		value, err := d.redisString()
+		if err != nil {
+			return "", nil, err
+		}
+		return key, &Object{typ: "string", value: value}, nil
+	case redisRdbTypeList, redisRdbTypeSet:
+		elems, err = d.redisStrings(1)
+	case redisRdbTypeHash:
+		elems, err = d.redisStrings(2)
+	case redisRdbTypeZSet, redisRdbTypeZSet2:
+		n, err := d.redisCount()
+		if err != nil {
+			return "", nil, err
+		}
+		entries := make([]zsetEntry, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			member, err := d.redisString()
+			if err != nil {
+				return "", nil, err
+			}
+			var score float64
+			if typ == redisRdbTypeZSet {
+				score, err = d.redisScore()
+			} else {
+				score, err = d.float64()
+			}
+			if err != nil {
+				return "", nil, err
+			}
+			if math.IsNaN(score) {
+				return "", nil, &RdbError{start, fmt.Sprintf("nan score for member %q", member)}
+			}
+			entries = append(entries, zsetEntry{member, score})
+		}
+		return key, &Object{typ: "zset", value: zsetFromEntries(entries)}, nil
+	case redisRdbTypeListZiplist, redisRdbTypeZSetZiplist, redisRdbTypeHashZiplist:
+		elems, err = d.redisEncoded(ziplistEntries)
+	case redisRdbTypeSetIntset:
+		elems, err = d.redisEncoded(intsetEntries)
+	case redisRdbTypeHashListpack, redisRdbTypeZSetListpack, redisRdbTypeSetListpack:
+		elems, err = d.redisEncoded(listpackEntries)
+	case redisRdbTypeListQuicklist, redisRdbTypeListQuick2:
+		n, err := d.redisCount()
+		if err != nil {
+			return "", nil, err
+		}
+		for i := 0; i < n; i++ {
+			container := 2
+			if typ == redisRdbTypeListQuick2 {
+				if container, err = d.redisCount(); err != nil {
+					return "", nil, err
+				}
+			}
+			var node []string
+			switch {
+			case container == quicklistNodePlain:
+				var elem string
+				elem, err = d.redisString()
+				node = []string{elem}
+			case typ == redisRdbTypeListQuicklist:
+				node, err = d.redisEncoded(ziplistEntries)
+			default:
+				node, err = d.redisEncoded(listpackEntries)
+			}
+			if err != nil {
+				return "", nil, err
+			}
+			elems = append(elems, node...)
+		}
+	default:
+		return "", nil, &RdbError{start, fmt.Sprintf("unsupported object type %d", typ)}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch typ {
+	case redisRdbTypeList, redisRdbTypeListZiplist, redisRdbTypeListQuicklist, redisRdbTypeListQuick2:
+		return key, &Object{typ: "list", value: elems}, nil
+	case redisRdbTypeSet, redisRdbTypeSetIntset, redisRdbTypeSetListpack:
+		set := make(map[string]struct{}, len(elems))
+		for _, member := range elems {
+			set[member] = struct{}{}
+		}
+		return key, &Object{typ: "set", value: set}, nil
+	}
+
+	if len(elems)%2 != 0 {
+		return "", nil, &RdbError{start, "odd number of elements in encoded pairs"}
+	}
+	if typ == redisRdbTypeZSetZiplist || typ == redisRdbTypeZSetListpack {
+		entries := make([]zsetEntry, 0, len(elems)/2)
+		for i := 0; i < len(elems); i += 2 {
+			score, ok := parseScore(elems[i+1])
+			if !ok {
+				return "", nil, &RdbError{start, fmt.Sprintf("invalid score %q", elems[i+1])}
+			}
+			entries = append(entries, zsetEntry{elems[i], score})
+		}
+		return key, &Object{typ: "zset", value: zsetFromEntries(entries)}, nil
+	}
+	fields := make(map[string]string, len(elems)/2)
+	for i := 0; i < len(elems); i += 2 {
+		fields[elems[i]] = elems[i+1]
+	}
+	return key, &Object{typ: "hash", value: fields}, nil
+}
+
+var errCorruptEncoding = errors.New("corrupt encoded value")
+
+// blob walks the compact encodings Redis nests inside strings.
+type blob struct {
+	b   []byte
+	pos int
+}
+
+func (b *blob) take(n int) ([]byte, error) {
+	if n < 0 || len(b.b)-b.pos < n {
+		return nil, errCorruptEncoding
+	}
+	p := b.b[b.pos : b.pos+n]
+	b.pos += n
+	return p, nil
+}
+
+func (b *blob) byte() (byte, error) {
+	p, err := b.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+func int24(p []byte) int64 {
+	return int64(int32(uint32(p[0])<<8|uint32(p[1])<<16|uint32(p[2])<<24) >> 8)
+}
+
+// blobInt reads a little endian signed integer of width bytes.
+func (b *blob) int(width int) (string, error) {
+	p, err := b.take(width)
+	if err != nil {
+		return "", err
+	}
+	var n int64
+	switch width {
+	case 1:
+		n = int64(int8(p[0]))
+	case 2:
+		n = int64(int16(binary.LittleEndian.Uint16(p)))
+	case 3:
+		n = int24(p)
+	case 4:
+		n = int64(int32(binary.LittleEndian.Uint32(p)))
+	default:
+		n = int64(binary.LittleEndian.Uint64(p))
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// ziplistEntries decodes a ziplist, the encoding of small lists, hashes and
+// sorted sets before Redis 7: a 10 byte header, then entries made of the
+// previous entry's length, an encoding byte and the data, then 0xFF.
+func ziplistEntries(zl []byte) ([]string, error) {
+	b := &blob{b: zl}
+	if _, err := b.take(10); err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	for {
+		prevlen, err := b.byte()
+		if err != nil {
+			return nil, err
+		}
+		if prevlen == 0xff {
+			return entries, nil
+		}
+		if prevlen == 0xfe {
+			if _, err := b.take(4); err != nil {
+				return nil, err
+			}
+		}
+
+		enc, err := b.byte()
+		if err != nil {
+			return nil, err
+		}
+		var entry string
+		switch {
+		case enc>>6 == 0:
+			var p []byte
+			p, err = b.take(int(enc & 0x3f))
+			entry = string(p)
+		case enc>>6 == 1:
+			var next byte
+			if next, err = b.byte(); err == nil {
+				var p []byte
+				p, err = b.take(int(enc&0x3f)<<8 | int(next))
+				entry = string(p)
+			}
+		case enc == 0x80:
+			var p []byte
+			if p, err = b.take(4); err == nil {
+				p, err = b.take(int(binary.BigEndian.Uint32(p)))
+				entry = string(p)
+			}
+		case enc == 0xc0:
+			entry, err = b.int(2)
+		case enc == 0xd0:
+			entry, err = b.int(4)
+		case enc == 0xe0:
+			entry, err = b.int(8)
+		case enc == 0xf0:
+			entry, err = b.int(3)
+		case enc == 0xfe:
+			entry, err = b.int(1)
+		case enc >= 0xf1 && enc <= 0xfd:
+			entry = strconv.Itoa(int(enc&0x0f) - 1)
+		default:
+			err = errCorruptEncoding
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// listpackEntries decodes a listpack, which replaced the ziplist in Redis
+// 7: a 6 byte header, then entries made of an encoding byte, the data and
+// the entry's own length stored backwards, then 0xFF.
+func listpackEntries(lp []byte) ([]string, error) {
+	b := &blob{b: lp}
+	if _, err := b.take(6); err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	for {
+		start := b.pos
+		enc, err := b.byte()
+		if err != nil {
+			return nil, err
+		}
+		if enc == 0xff {
+			return entries, nil
+		}
+
+		var entry string
+		switch {
+		case enc&0x80 == 0:
+			entry = strconv.Itoa(int(enc))
+		case enc&0xc0 == 0x80:
+			var p []byte
+			p, err = b.take(int(enc & 0x3f))
+			entry = string(p)
+		case enc&0xe0 == 0xc0:
+			var next byte
+			if next, err = b.byte(); err == nil {
+				n := int(enc&0x1f)<<8 | int(next)
+				if n >= 1<<12 {
+					n -= 1 << 13
+				}
+				entry = strconv.Itoa(n)
+			}
+		case enc&0xf0 == 0xe0:
+			var next byte
+			if next, err = b.byte(); err == nil {
+				var p []byte
+				p, err = b.take(int(enc&0x0f)<<8 | int(next))
+				entry = string(p)
+			}
+		case enc == 0xf0:
+			var p []byte
+			if p, err = b.take(4); err == nil {
+				p, err = b.take(int(binary.LittleEndian.Uint32(p)))
+				entry = string(p)
+			}
+		case enc == 0xf1:
+			entry, err = b.int(2)
+		case enc == 0xf2:
+			entry, err = b.int(3)
+		case enc == 0xf3:
+			entry, err = b.int(4)
+		case enc == 0xf4:
+			entry, err = b.int(8)
+		default:
+			err = errCorruptEncoding
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := b.take(listpackBacklen(b.pos - start)); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// listpackBacklen returns how many bytes the backwards length of an entry
+// of size bytes takes, following lpEncodeBacklen in Redis.
+func listpackBacklen(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// intsetEntries decodes an intset: the integer width, the count and the
+// sorted little endian integers.
+func intsetEntries(is []byte) ([]string, error) {
+	b := &blob{b: is}
+	header, err := b.take(8)
+	if err != nil {
+		return nil, err
+	}
+	width := int(binary.LittleEndian.Uint32(header))
+	n := int(binary.LittleEndian.Uint32(header[4:]))
+	if width != 2 && width != 4 && width != 8 || n > len(is)/width {
+		return nil, errCorruptEncoding
+	}
+
+	entries := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		entry, err := b.int(width)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// lzfDecompress expands LZF data: runs of literal bytes and back
+// references into the output produced so far.
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 1<<5 {
+			run := ctrl + 1
+			if i+run > len(in) || len(out)+run > n {
+				return nil, errors.New("corrupt lzf data")
+			}
+			out = append(out, in[i:i+run]...)
+			i += run
+			continue
+		}
+
+		run := ctrl >> 5
+		if run == 7 {
+			if i == len(in) {
+				return nil, errors.New("corrupt lzf data")
+			}
+			run += int(in[i])
+			i++
+		}
+		if i == len(in) {
+			return nil, errors.New("corrupt lzf data")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		run += 2
+		if ref < 0 || len(out)+run > n {
+			return nil, errors.New("corrupt lzf data")
+		}
+		// the reference may overlap what it produces, so copy bytewise
+		for j := 0; j < run; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, errors.New("corrupt lzf data")
+	}
+	return out, nil
+}
+
+// encodeRedisRdb writes entries to w as a Redis RDB file, counting the
+// keys written in progress.
+func encodeRedisRdb(w io.Writer, entries []rdbEntry, progress *atomic.Int64) error {
+	enc := &rdbEncoder{w: w}
+
+	enc.write([]byte(fmt.Sprintf("%s%04d", redisRdbMagic, redisRdbVersion)))
+	enc.redisAux("redis-ver", serverVersion)
+	enc.redisAux("redis-bits", "64")
+	enc.redisAux("ctime", fmt.Sprint(time.Now().Unix()))
+
+	expires := 0
+	for _, e := range entries {
+		if e.expire != -1 {
+			expires++
+		}
+	}
+	enc.opcode(redisRdbOpSelectDB)
+	enc.redisLength(0)
+	enc.opcode(redisRdbOpResizeDB)
+	enc.redisLength(len(entries))
+	enc.redisLength(expires)
+
+	for _, e := range entries {
+		if e.expire != -1 {
+			enc.opcode(rdbOpExpire)
+			enc.int64(e.expire)
+		}
+		enc.redisObject(e.key, e.obj)
+		progress.Add(1)
+	}
+
+	enc.footer()
+	return enc.err
+}
+
+func (e *rdbEncoder) redisLength(n int) {
+	switch {
+	case n < 1<<6:
+		e.write([]byte{byte(n)})
+	case n < 1<<14:
+		e.write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= math.MaxUint32:
+		e.write(binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n)))
+	default:
+		e.write(binary.BigEndian.AppendUint64([]byte{0x81}, uint64(n)))
+	}
+}
+
+func (e *rdbEncoder) redisString(s string) {
+	e.redisLength(len(s))
+	e.write([]byte(s))
+}
+
+func (e *rdbEncoder) redisAux(name, value string) {
+	e.opcode(rdbOpAux)
+	e.redisString(name)
+	e.redisString(value)
+}
+
+func (e *rdbEncoder) redisObject(key string, o *Object) {
+	switch v := o.value.(type) {
+	case string:
+		e.opcode(redisRdbTypeString)
+		e.redisString(key)
+		e.redisString(v)
+	case []string:
+		e.opcode(redisRdbTypeList)
+		e.redisString(key)
+		e.redisLength(len(v))
+		for _, elem := range v {
+			e.redisString(elem)
+		}
+	case map[string]struct{}:
+		e.opcode(redisRdbTypeSet)
+		e.redisString(key)
+		e.redisLength(len(v))
+		for member := range v {
+			e.redisString(member)
+		}
+	case map[string]string:
+		e.opcode(redisRdbTypeHash)
+		e.redisString(key)
+		e.redisLength(len(v))
+		for field, value := range v {
+			e.redisString(field)
+			e.redisString(value)
+		}
+	case *ZSET:
+		e.opcode(redisRdbTypeZSet2)
+		e.redisString(key)
+		e.redisLength(len(v.elements))
+		// highest first, like Redis, which loads a skiplist fastest that
+		// way; zsetFromEntries flips it back without sorting
+		v.treap.Walk(1, v.treap.size, true, func(node *TreapNode) bool {
+			e.redisString(node.value)
+			e.float64(node.key)
+			return true
+		})
+	}
+}
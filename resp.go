@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 )
 
@@ -13,14 +16,50 @@ const (
 	INTEGER = ':'
 	BULK    = '$'
 	ARRAY   = '*'
+
+	// RESP3
+	NULL      = '_'
+	DOUBLE    = ','
+	BOOLEAN   = '#'
+	BLOBERROR = '!'
+	VERBATIM  = '='
+	BIGNUMBER = '('
+	MAP       = '%'
+	SET       = '~'
+	ATTRIBUTE = '|'
+	PUSH      = '>'
+)
+
+const (
+	maxArrayLen  = 1024 * 1024
+	maxBulkLen   = 512 * 1024 * 1024
+	maxInlineLen = 64 * 1024
+	maxQueryLen  = 1024 * 1024 * 1024 // pending input of one client
 )
 
+var ErrIncomplete = errors.New("incomplete resp value")
+
+// ProtocolError reports input that is not valid RESP. The stream cannot be
+// resynchronised after one, so connections are closed on it.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+// Value is a single RESP value. Maps and attributes keep their entries in
+// array as alternating keys and values, booleans are stored in num as 0 or
+// 1, big numbers in str and verbatim strings in bulk with the format in str.
 type Value struct {
 	typ   string
 	str   string
 	num   int
+	dbl   float64
 	bulk  string
 	array []Value
+	attrs []Value
 }
 
 type Resp struct {
@@ -28,7 +67,8 @@ type Resp struct {
 }
 
 type Write struct {
-	writer io.Writer
+	writer *bufio.Writer
+	proto  int
 }
 
 func NewResp(reader io.Reader) *Resp {
@@ -36,11 +76,13 @@ func NewResp(reader io.Reader) *Resp {
 }
 
 func NewWrite(writer io.Writer) *Write {
-	return &Write{writer: writer}
+	return &Write{writer: bufio.NewWriterSize(writer, 16*1024), proto: 2}
 }
 
+// Write buffers v; nothing reaches the connection until Flush is called or
+// the buffer fills up.
 func (w *Write) Write(v Value) error {
-	var bytes = v.Marshal()
+	var bytes = v.MarshalResp(w.proto)
 
 	_, err := w.writer.Write(bytes)
 	if err != nil {
@@ -49,19 +91,33 @@ func (w *Write) Write(v Value) error {
 	return nil
 }
 
+func (w *Write) Flush() error {
+	return w.writer.Flush()
+}
+
 func (r *Resp) readLine() (line []byte, n int, err error) {
-	for {
-		b, err := r.reader.ReadByte()
-		if err != nil {
-			return nil, 0, err
-		}
-		n += 1
-		line = append(line, b)
-		if len(line) >= 2 && line[len(line)-2] == '\r' {
-			break
+	line, err = r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		var buf []byte
+		buf = append(buf, line...)
+		for err == bufio.ErrBufferFull {
+			// headers are short; a line this long is not one
+			if len(buf) > maxInlineLen {
+				return nil, 0, &ProtocolError{"too big header line"}
+			}
+			line, err = r.reader.ReadSlice('\n')
+			buf = append(buf, line...)
 		}
+		line = buf
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	n = len(line)
+	if n < 2 || line[n-2] != '\r' {
+		return nil, n, &ProtocolError{"expected CRLF line terminator"}
 	}
-	return line[:len(line)-2], n, nil
+	return append([]byte(nil), line[:n-2]...), n, nil
 }
 
 func (r *Resp) readInteger() (x int, n int, err error) {
@@ -69,29 +125,431 @@ func (r *Resp) readInteger() (x int, n int, err error) {
 	if err != nil {
 		return 0, 0, err
 	}
-	i64, err := strconv.ParseInt(string(line), 10, 32)
+	i64, err := strconv.ParseInt(string(line), 10, 64)
 	if err != nil {
-		return 0, n, err
+		return 0, n, &ProtocolError{fmt.Sprintf("invalid integer %q", line)}
 	}
 	return int(i64), n, nil
 }
 
+// Read decodes the next RESP2 value. A value cut off by the end of the
+// stream is reported as io.ErrUnexpectedEOF, malformed input as a
+// *ProtocolError.
 func (r *Resp) Read() (Value, error) {
 	_type, err := r.reader.ReadByte()
 	if err != nil {
 		return Value{}, err
 	}
+
+	var v Value
 	switch _type {
 	case ARRAY:
-		return r.readArray()
+		v, err = r.readArray()
 	case BULK:
-		return r.readBulk()
+		v, err = r.readBulk()
+	case STRING:
+		v, err = r.readSimple("string")
+	case ERROR:
+		v, err = r.readSimple("error")
+	case INTEGER:
+		v, err = r.readInt()
+	case NULL:
+		_, _, err = r.readLine()
+		v = Value{typ: "null"}
+	case DOUBLE:
+		v, err = r.readDouble()
+	case BOOLEAN:
+		v, err = r.readBoolean()
+	case BLOBERROR:
+		v, err = r.readBulk()
+		v = Value{typ: "error", str: v.bulk}
+	case VERBATIM:
+		v, err = r.readVerbatim()
+	case BIGNUMBER:
+		v, err = r.readSimple("bignum")
+	case MAP:
+		v, err = r.readAggregate("map", 2)
+	case SET:
+		v, err = r.readAggregate("set", 1)
+	case PUSH:
+		v, err = r.readAggregate("push", 1)
+	case ATTRIBUTE:
+		v, err = r.readAttribute()
 	default:
-		fmt.Printf("Unknown type: %c\n", _type)
-		return Value{}, nil
+		return Value{}, &ProtocolError{fmt.Sprintf("unknown type byte %q", _type)}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+// ReadCommand reads the next client request. Requests are normally RESP
+// arrays, but a line that does not start with '*' is parsed as an inline
+// command the way telnet users type it.
+func (r *Resp) ReadCommand() (Value, error) {
+	for {
+		b, err := r.reader.Peek(1)
+		if err != nil {
+			return Value{}, err
+		}
+		if b[0] == ARRAY {
+			v, err := r.Read()
+			if err != nil {
+				return v, err
+			}
+			for _, arg := range v.array {
+				if arg.typ != "bulk" {
+					return Value{}, &ProtocolError{"expected '$'"}
+				}
+			}
+			return v, nil
+		}
+
+		line, err := r.readInline()
+		if err != nil {
+			return Value{}, err
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return Value{}, err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		v := Value{typ: "array", array: make([]Value, 0, len(args))}
+		for _, arg := range args {
+			v.array = append(v.array, Value{typ: "bulk", bulk: arg})
+		}
+		return v, nil
 	}
 }
 
+func (r *Resp) readInline() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxInlineLen {
+			return "", &ProtocolError{"too big inline request"}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		break
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return string(line), nil
+}
+
+// splitArgs splits an inline command into arguments. Arguments may be
+// wrapped in double quotes, which understand the usual backslash escapes
+// and \xHH, or in single quotes, which only understand \'.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	p := 0
+	for {
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return args, nil
+		}
+
+		var current []byte
+		inq, insq, done := false, false, false
+		for !done {
+			if inq {
+				if p == len(line) {
+					return nil, &ProtocolError{"unbalanced quotes in request"}
+				}
+				if line[p] == '\\' && p+3 < len(line) && line[p+1] == 'x' && isHex(line[p+2]) && isHex(line[p+3]) {
+					current = append(current, hexValue(line[p+2])<<4|hexValue(line[p+3]))
+					p += 3
+				} else if line[p] == '\\' && p+1 < len(line) {
+					p++
+					switch line[p] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[p])
+					}
+				} else if line[p] == '"' {
+					// the closing quote must be followed by a space or end the line
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, &ProtocolError{"unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else if insq {
+				if p == len(line) {
+					return nil, &ProtocolError{"unbalanced quotes in request"}
+				}
+				if line[p] == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					current = append(current, '\'')
+				} else if line[p] == '\'' {
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, &ProtocolError{"unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else {
+				if p == len(line) {
+					break
+				}
+				switch line[p] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					current = append(current, line[p])
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		args = append(args, string(current))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// ParseBuffer decodes one value from the front of buf and reports how many
+// bytes it used. ErrIncomplete means buf only holds part of a value.
+func ParseBuffer(buf []byte) (Value, int, error) {
+	return parseBuffer(buf, (*Resp).Read)
+}
+
+// ParseCommand is ParseBuffer for client requests, accepting inline
+// commands as well.
+func ParseCommand(buf []byte) (Value, int, error) {
+	return parseBuffer(buf, (*Resp).ReadCommand)
+}
+
+// requestScanner tells whether a growing buffer holds a whole request
+// without decoding it. It jumps over bulk payloads and remembers how far it
+// got, so a large request arriving over many reads is looked at once
+// instead of being parsed again from the start on every read.
+type requestScanner struct {
+	pos    int // end of the part of the request scanned so far
+	header bool
+	args   int // bulks still to skip once the header is read
+}
+
+// scan reports whether buf, which starts with the request being scanned,
+// holds all of it. Malformed input counts as whole so that the parser gets
+// to report it.
+func (s *requestScanner) scan(buf []byte) bool {
+	for !s.header {
+		if s.pos >= len(buf) {
+			return false
+		}
+		if buf[s.pos] == ARRAY {
+			n, complete, bad := s.length(buf)
+			if bad || !complete {
+				return bad
+			}
+			s.header, s.args = true, n
+			break
+		}
+
+		end := bytes.IndexByte(buf[s.pos:], '\n')
+		if end < 0 {
+			return len(buf)-s.pos > maxInlineLen
+		}
+		blank := len(bytes.TrimFunc(buf[s.pos:s.pos+end], func(r rune) bool {
+			return r < 0x80 && isSpace(byte(r))
+		})) == 0
+		s.pos += end + 1
+		// ReadCommand skips blank lines, so they belong to the request after them
+		if !blank {
+			return true
+		}
+	}
+
+	for ; s.args > 0; s.args-- {
+		if s.pos >= len(buf) {
+			return false
+		}
+		if buf[s.pos] != BULK {
+			return true
+		}
+		n, complete, bad := s.length(buf)
+		if bad || !complete {
+			return bad
+		}
+		if n < 0 || n > maxBulkLen {
+			return true
+		}
+		s.pos += n + 2
+	}
+	return s.pos <= len(buf)
+}
+
+// length reads the length in the header line at s.pos and moves past it.
+// complete is false while the line has not fully arrived, bad is set when
+// it is not a valid header.
+func (s *requestScanner) length(buf []byte) (n int, complete, bad bool) {
+	end := bytes.IndexByte(buf[s.pos:], '\n')
+	if end < 0 {
+		return 0, false, len(buf)-s.pos > maxInlineLen
+	}
+	n, err := strconv.Atoi(string(bytes.TrimSuffix(buf[s.pos+1:s.pos+end], []byte{'\r'})))
+	if err != nil {
+		return 0, true, true
+	}
+	s.pos += end + 1
+	return n, true, false
+}
+
+func parseBuffer(buf []byte, read func(*Resp) (Value, error)) (Value, int, error) {
+	br := bytes.NewReader(buf)
+	r := NewResp(br)
+
+	v, err := read(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Value{}, 0, ErrIncomplete
+	}
+	if err != nil {
+		return Value{}, 0, err
+	}
+	return v, len(buf) - br.Len() - r.reader.Buffered(), nil
+}
+
+func (r *Resp) readSimple(typ string) (Value, error) {
+	line, _, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{typ: typ, str: string(line)}, nil
+}
+
+func (r *Resp) readInt() (Value, error) {
+	n, _, err := r.readInteger()
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{typ: "integer", num: n}, nil
+}
+
+func (r *Resp) readDouble() (Value, error) {
+	line, _, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	f, err := strconv.ParseFloat(string(line), 64)
+	if err != nil {
+		return Value{}, &ProtocolError{fmt.Sprintf("invalid double %q", line)}
+	}
+	return Value{typ: "double", dbl: f}, nil
+}
+
+func (r *Resp) readBoolean() (Value, error) {
+	line, _, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	switch string(line) {
+	case "t":
+		return Value{typ: "boolean", num: 1}, nil
+	case "f":
+		return Value{typ: "boolean", num: 0}, nil
+	}
+	return Value{}, &ProtocolError{fmt.Sprintf("invalid boolean %q", line)}
+}
+
+func (r *Resp) readVerbatim() (Value, error) {
+	v, err := r.readBulk()
+	if err != nil || v.typ == "null" {
+		return v, err
+	}
+	if len(v.bulk) < 4 || v.bulk[3] != ':' {
+		return Value{}, &ProtocolError{"invalid verbatim string"}
+	}
+	return Value{typ: "verbatim", str: v.bulk[:3], bulk: v.bulk[4:]}, nil
+}
+
+// readAggregate reads the map, set and push types, which share the array
+// layout but hold width values per counted element.
+func (r *Resp) readAggregate(typ string, width int) (Value, error) {
+	n, _, err := r.readInteger()
+	if err != nil {
+		return Value{}, err
+	}
+	if n < 0 || n > maxArrayLen {
+		return Value{}, &ProtocolError{fmt.Sprintf("invalid %s length %d", typ, n)}
+	}
+
+	v := Value{typ: typ, array: make([]Value, 0, min(n*width, 1024))}
+	for i := 0; i < n*width; i++ {
+		val, err := r.Read()
+		if err != nil {
+			return v, err
+		}
+		v.array = append(v.array, val)
+	}
+	return v, nil
+}
+
+// readAttribute reads an attribute map and the value it annotates.
+func (r *Resp) readAttribute() (Value, error) {
+	attrs, err := r.readAggregate("map", 2)
+	if err != nil {
+		return Value{}, err
+	}
+	v, err := r.Read()
+	if err != nil {
+		return v, err
+	}
+	v.attrs = attrs.array
+	return v, nil
+}
+
 func (r *Resp) readArray() (Value, error) {
 	v := Value{}
 	v.typ = "array"
@@ -100,8 +558,14 @@ func (r *Resp) readArray() (Value, error) {
 	if err != nil {
 		return v, err
 	}
+	if n == -1 {
+		return Value{typ: "nullarray"}, nil
+	}
+	if n < 0 || n > maxArrayLen {
+		return v, &ProtocolError{fmt.Sprintf("invalid array length %d", n)}
+	}
 
-	v.array = make([]Value, 0)
+	v.array = make([]Value, 0, min(n, 1024))
 	for i := 0; i < n; i++ {
 		val, err := r.Read()
 		if err != nil {
@@ -120,30 +584,109 @@ func (r *Resp) readBulk() (Value, error) {
 	if err != nil {
 		return v, err
 	}
+	if n == -1 {
+		return Value{typ: "null"}, nil
+	}
+	if n < 0 || n > maxBulkLen {
+		return v, &ProtocolError{fmt.Sprintf("invalid bulk length %d", n)}
+	}
 
-	buf := make([]byte, n)
-	r.reader.Read(buf)
-
-	v.bulk = string(buf)
-	r.readLine()
+	// the declared length is only trusted as far as the bytes that arrive,
+	// so the buffer grows with them instead of being allocated up front
+	var buf bytes.Buffer
+	buf.Grow(min(n+2, 64*1024))
+	if _, err := io.CopyN(&buf, r.reader, int64(n+2)); err != nil {
+		return v, err
+	}
+	b := buf.Bytes()
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return v, &ProtocolError{"expected CRLF after bulk string"}
+	}
 
+	v.bulk = string(b[:n])
 	return v, nil
 }
 
+// Marshal encodes v as RESP2, the format used on disk and by default on
+// every connection.
 func (v Value) Marshal() []byte {
+	return v.MarshalResp(2)
+}
+
+// MarshalResp encodes v for a connection speaking the given protocol
+// version. RESP3-only types are downgraded to their RESP2 equivalents when
+// proto is 2.
+func (v Value) MarshalResp(proto int) []byte {
+	var bytes []byte
+	if proto == 3 && len(v.attrs) > 0 {
+		bytes = marshalAggregate(ATTRIBUTE, v.attrs, len(v.attrs)/2, proto)
+	}
+
 	switch v.typ {
 	case "array":
-		return v.MarshalArray()
+		return append(bytes, v.MarshalArray(proto)...)
 	case "bulk":
-		return v.marshalBulk()
+		return append(bytes, v.marshalBulk()...)
 	case "integer":
-		return v.marshalInteger()
+		return append(bytes, v.marshalInteger()...)
 	case "string":
-		return v.marshalString()
-	case "null":
-		return v.marshalNull()
+		return append(bytes, v.marshalString()...)
+	case "null", "nullarray":
+		if proto == 3 {
+			return append(bytes, NULL, '\r', '\n')
+		}
+		if v.typ == "nullarray" {
+			return append(bytes, "*-1\r\n"...)
+		}
+		return append(bytes, v.marshalNull()...)
 	case "error":
-		return v.marshalError()
+		return append(bytes, v.marshalError()...)
+	case "map":
+		if proto == 3 {
+			return append(bytes, marshalAggregate(MAP, v.array, len(v.array)/2, proto)...)
+		}
+		return append(bytes, v.MarshalArray(proto)...)
+	case "pairs":
+		// members with their scores: a flat array in RESP2, an array of
+		// two element arrays in RESP3
+		if proto == 3 {
+			pairs := make([]Value, 0, len(v.array)/2)
+			for i := 0; i+1 < len(v.array); i += 2 {
+				pairs = append(pairs, Value{typ: "array", array: v.array[i : i+2]})
+			}
+			return append(bytes, marshalAggregate(ARRAY, pairs, len(pairs), proto)...)
+		}
+		return append(bytes, v.MarshalArray(proto)...)
+	case "set":
+		if proto == 3 {
+			return append(bytes, marshalAggregate(SET, v.array, len(v.array), proto)...)
+		}
+		return append(bytes, v.MarshalArray(proto)...)
+	case "push":
+		if proto == 3 {
+			return append(bytes, marshalAggregate(PUSH, v.array, len(v.array), proto)...)
+		}
+		return append(bytes, v.MarshalArray(proto)...)
+	case "double":
+		if proto == 3 {
+			return append(bytes, v.marshalDouble()...)
+		}
+		return append(bytes, Value{typ: "bulk", bulk: formatDouble(v.dbl)}.marshalBulk()...)
+	case "boolean":
+		if proto == 3 {
+			return append(bytes, v.marshalBoolean()...)
+		}
+		return append(bytes, v.marshalInteger()...)
+	case "bignum":
+		if proto == 3 {
+			return append(bytes, v.marshalBigNumber()...)
+		}
+		return append(bytes, Value{typ: "bulk", bulk: v.str}.marshalBulk()...)
+	case "verbatim":
+		if proto == 3 {
+			return append(bytes, v.marshalVerbatim()...)
+		}
+		return append(bytes, v.marshalBulk()...)
 	default:
 		return []byte{}
 	}
@@ -176,15 +719,18 @@ func (v Value) marshalInteger() []byte {
 	return bytes
 }
 
-func (v Value) MarshalArray() []byte {
-	n := len(v.array)
+func (v Value) MarshalArray(proto int) []byte {
+	return marshalAggregate(ARRAY, v.array, len(v.array), proto)
+}
+
+func marshalAggregate(prefix byte, values []Value, n int, proto int) []byte {
 	var bytes []byte
-	bytes = append(bytes, ARRAY)
+	bytes = append(bytes, prefix)
 	bytes = append(bytes, strconv.Itoa(n)...)
 	bytes = append(bytes, '\r', '\n')
 
-	for i := 0; i < n; i++ {
-		bytes = append(bytes, v.array[i].marshalBulk()...)
+	for i := range values {
+		bytes = append(bytes, values[i].MarshalResp(proto)...)
 	}
 	return bytes
 }
@@ -200,3 +746,54 @@ func (v Value) marshalError() []byte {
 func (v Value) marshalNull() []byte {
 	return []byte("$-1\r\n")
 }
+
+func (v Value) marshalDouble() []byte {
+	var bytes []byte
+	bytes = append(bytes, DOUBLE)
+	bytes = append(bytes, formatDouble(v.dbl)...)
+	bytes = append(bytes, '\r', '\n')
+	return bytes
+}
+
+func (v Value) marshalBoolean() []byte {
+	if v.num != 0 {
+		return []byte("#t\r\n")
+	}
+	return []byte("#f\r\n")
+}
+
+func (v Value) marshalBigNumber() []byte {
+	var bytes []byte
+	bytes = append(bytes, BIGNUMBER)
+	bytes = append(bytes, v.str...)
+	bytes = append(bytes, '\r', '\n')
+	return bytes
+}
+
+func (v Value) marshalVerbatim() []byte {
+	format := v.str
+	if len(format) != 3 {
+		format = "txt"
+	}
+	var bytes []byte
+	bytes = append(bytes, VERBATIM)
+	bytes = append(bytes, strconv.Itoa(len(v.bulk)+4)...)
+	bytes = append(bytes, '\r', '\n')
+	bytes = append(bytes, format...)
+	bytes = append(bytes, ':')
+	bytes = append(bytes, v.bulk...)
+	bytes = append(bytes, '\r', '\n')
+	return bytes
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
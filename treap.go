@@ -5,10 +5,13 @@ import (
 	"math/rand"
 )
 
+// TreapNode is a sorted set member: nodes are ordered by score (key) and
+// then by member (value), the way Redis orders ties.
 type TreapNode struct {
-	key, priority, size int
-	value               string
-	l, r                *TreapNode
+	key            float64
+	priority, size int
+	value          string
+	l, r           *TreapNode
 }
 
 type Treap struct {
@@ -16,7 +19,7 @@ type Treap struct {
 	size int
 }
 
-func NewTreapNode(key int, value string) *TreapNode {
+func NewTreapNode(key float64, value string) *TreapNode {
 	return &TreapNode{key: key, value: value, priority: rand.Int(), size: 1}
 }
 
@@ -59,7 +62,7 @@ func zag(p **TreapNode) {
 	pushUp(*p)
 }
 
-func (t *Treap) Insert(key int, value string) (*TreapNode, bool) {
+func (t *Treap) Insert(key float64, value string) (*TreapNode, bool) {
 	node, ok := insert(&t.root, key, value)
 	if ok {
 		t.size++
@@ -68,7 +71,7 @@ func (t *Treap) Insert(key int, value string) (*TreapNode, bool) {
 	return nil, false
 }
 
-func insert(u **TreapNode, key int, value string) (*TreapNode, bool) {
+func insert(u **TreapNode, key float64, value string) (*TreapNode, bool) {
 	if *u == nil {
 		*u = NewTreapNode(key, value)
 		return *u, true
@@ -93,12 +96,15 @@ func insert(u **TreapNode, key int, value string) (*TreapNode, bool) {
 	}
 }
 
-func (t *Treap) Erase(key int, value string) {
+func (t *Treap) Erase(key float64, value string) bool {
+	if !erase(&t.root, key, value) {
+		return false
+	}
 	t.size--
-	erase(&t.root, key, value)
+	return true
 }
 
-func erase(u **TreapNode, key int, value string) bool {
+func erase(u **TreapNode, key float64, value string) bool {
 	if *u == nil {
 		return false
 	}
@@ -152,6 +158,242 @@ func getNodeByRank(u *TreapNode, rank int) *TreapNode {
 	}
 }
 
+func nodeSize(u *TreapNode) int {
+	if u == nil {
+		return 0
+	}
+	return u.size
+}
+
+// compare orders (key, value) against node u.
+func compare(key float64, value string, u *TreapNode) int {
+	switch {
+	case key < u.key || key == u.key && value < u.value:
+		return -1
+	case key > u.key || key == u.key && value > u.value:
+		return 1
+	}
+	return 0
+}
+
+// Rank returns the 1-based position of (key, value), or 0 if it is not in
+// the tree.
+func (t *Treap) Rank(key float64, value string) int {
+	rank := 0
+	for u := t.root; u != nil; {
+		switch compare(key, value, u) {
+		case -1:
+			u = u.l
+		case 1:
+			rank += nodeSize(u.l) + 1
+			u = u.r
+		default:
+			return rank + nodeSize(u.l) + 1
+		}
+	}
+	return 0
+}
+
+// LowerBound returns the rank of the first node at or after (key, value),
+// or size+1 when every node is before it.
+func (t *Treap) LowerBound(key float64, value string) int {
+	return t.bound(key, value, false)
+}
+
+// UpperBound returns the rank of the first node after (key, value), or
+// size+1 when there is none.
+func (t *Treap) UpperBound(key float64, value string) int {
+	return t.bound(key, value, true)
+}
+
+func (t *Treap) bound(key float64, value string, upper bool) int {
+	n := 0
+	for u := t.root; u != nil; {
+		if c := compare(key, value, u); c > 0 || c == 0 && upper {
+			n += nodeSize(u.l) + 1
+			u = u.r
+		} else {
+			u = u.l
+		}
+	}
+	return n + 1
+}
+
+// CountBefore returns how many nodes satisfy before, which must hold for a
+// prefix of the nodes in order and fail for the rest, in O(log n).
+func (t *Treap) CountBefore(before func(node *TreapNode) bool) int {
+	n := 0
+	for u := t.root; u != nil; {
+		if before(u) {
+			n += nodeSize(u.l) + 1
+			u = u.r
+		} else {
+			u = u.l
+		}
+	}
+	return n
+}
+
+// Walk calls fn on the nodes ranked from to to (1-based, inclusive), from
+// the highest rank down when reverse is set, until fn returns false. It
+// costs O(log n) plus the number of nodes visited.
+func (t *Treap) Walk(from, to int, reverse bool, fn func(node *TreapNode) bool) {
+	walk(t.root, max(from, 1), min(to, t.size), 0, reverse, fn)
+}
+
+func walk(u *TreapNode, from, to, offset int, reverse bool, fn func(node *TreapNode) bool) bool {
+	if u == nil || from > to {
+		return true
+	}
+	rank := offset + nodeSize(u.l) + 1
+	left := func() bool {
+		return from >= rank || walk(u.l, from, to, offset, reverse, fn)
+	}
+	right := func() bool {
+		return to <= rank || walk(u.r, from, to, rank, reverse, fn)
+	}
+	self := func() bool {
+		return rank < from || rank > to || fn(u)
+	}
+
+	if reverse {
+		return right() && self() && left()
+	}
+	return left() && self() && right()
+}
+
+// SplitBefore moves the nodes that satisfy before, which must hold for a
+// prefix of the nodes in order as for CountBefore, into a treap of their
+// own and leaves the rest in t, in O(log n).
+func (t *Treap) SplitBefore(before func(node *TreapNode) bool) *Treap {
+	l, r := split(t.root, before)
+	t.root, t.size = r, nodeSize(r)
+	return &Treap{root: l, size: nodeSize(l)}
+}
+
+// SplitRank moves the first k nodes into a treap of their own and leaves
+// the rest in t, in O(log n).
+func (t *Treap) SplitRank(k int) *Treap {
+	l, r := splitRank(t.root, k)
+	t.root, t.size = r, nodeSize(r)
+	return &Treap{root: l, size: nodeSize(l)}
+}
+
+// Merge appends the nodes of o, which must all order after those of t,
+// and leaves o empty, in O(log n).
+func (t *Treap) Merge(o *Treap) {
+	t.root = merge(t.root, o.root)
+	t.size += o.size
+	o.root, o.size = nil, 0
+}
+
+func split(u *TreapNode, before func(node *TreapNode) bool) (l, r *TreapNode) {
+	if u == nil {
+		return nil, nil
+	}
+	if before(u) {
+		u.r, r = split(u.r, before)
+		pushUp(u)
+		return u, r
+	}
+	l, u.l = split(u.l, before)
+	pushUp(u)
+	return l, u
+}
+
+func splitRank(u *TreapNode, k int) (l, r *TreapNode) {
+	if u == nil {
+		return nil, nil
+	}
+	if lsize := nodeSize(u.l); lsize < k {
+		u.r, r = splitRank(u.r, k-lsize-1)
+		pushUp(u)
+		return u, r
+	}
+	l, u.l = splitRank(u.l, k)
+	pushUp(u)
+	return l, u
+}
+
+func merge(l, r *TreapNode) *TreapNode {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	if l.priority > r.priority {
+		l.r = merge(l.r, r)
+		pushUp(l)
+		return l
+	}
+	r.l = merge(l, r.l)
+	pushUp(r)
+	return r
+}
+
+// BuildTreap links nodes, which must be fresh and already in order, into a
+// treap in O(n). Each node is hung off the right spine of the tree built
+// so far, taking over the part of the spine with lower priorities as its
+// left subtree.
+func BuildTreap(nodes []*TreapNode) *Treap {
+	var spine []*TreapNode
+	for _, u := range nodes {
+		var last *TreapNode
+		for len(spine) > 0 && spine[len(spine)-1].priority < u.priority {
+			last = spine[len(spine)-1]
+			spine = spine[:len(spine)-1]
+		}
+		u.l = last
+		if len(spine) > 0 {
+			spine[len(spine)-1].r = u
+		}
+		spine = append(spine, u)
+	}
+	if len(spine) == 0 {
+		return NewTreap()
+	}
+	resize(spine[0])
+	return &Treap{root: spine[0], size: len(nodes)}
+}
+
+func resize(u *TreapNode) int {
+	if u == nil {
+		return 0
+	}
+	u.size = resize(u.l) + resize(u.r) + 1
+	return u.size
+}
+
+// Clone copies the tree node by node, keeping its shape, in O(n).
+func (t *Treap) Clone() *Treap {
+	return &Treap{root: cloneNode(t.root), size: t.size}
+}
+
+func cloneNode(u *TreapNode) *TreapNode {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	c.l = cloneNode(u.l)
+	c.r = cloneNode(u.r)
+	return &c
+}
+
+// Each calls fn on every node in order.
+func (t *Treap) Each(fn func(node *TreapNode)) {
+	each(t.root, fn)
+}
+
+func each(u *TreapNode, fn func(node *TreapNode)) {
+	if u == nil {
+		return
+	}
+	each(u.l, fn)
+	fn(u)
+	each(u.r, fn)
+}
+
 func (t *Treap) Bfs() {
 	if t.root == nil {
 		return
@@ -167,7 +409,7 @@ func (t *Treap) Bfs() {
 				fmt.Printf("[%d]", 0)
 			} else {
 				//fmt.Printf("key: %d, value: %s, priority: %d, size: %d  ", node.key, node.value, node.priority, node.size)
-				fmt.Printf("[%d]", node.key)
+				fmt.Printf("[%g]", node.key)
 				nextLevel = append(nextLevel, node.l)
 				nextLevel = append(nextLevel, node.r)
 			}
@@ -188,6 +430,6 @@ func inorder(p *TreapNode) {
 		return
 	}
 	inorder(p.l)
-	fmt.Printf("key: %d, value: %s\n", p.key, p.value)
+	fmt.Printf("key: %g, value: %s\n", p.key, p.value)
 	inorder(p.r)
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// checkTreap verifies the order, the size fields and the heap property of
+// t, and that it holds exactly want.
+func checkTreap(t *testing.T, tr *Treap, want []zsetEntry) {
+	t.Helper()
+	var check func(u *TreapNode) int
+	check = func(u *TreapNode) int {
+		if u == nil {
+			return 0
+		}
+		for _, c := range []*TreapNode{u.l, u.r} {
+			if c != nil && c.priority > u.priority {
+				t.Fatalf("%s: child %s has a higher priority", u.value, c.value)
+			}
+		}
+		size := check(u.l) + check(u.r) + 1
+		if u.size != size {
+			t.Fatalf("%s: size %d, counted %d", u.value, u.size, size)
+		}
+		return size
+	}
+	if size := check(tr.root); tr.size != size {
+		t.Fatalf("treap size %d, counted %d", tr.size, size)
+	}
+
+	var got []zsetEntry
+	tr.Each(func(node *TreapNode) {
+		got = append(got, zsetEntry{node.value, node.key})
+	})
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func checkZSet(t *testing.T, z *ZSET, want []zsetEntry) {
+	t.Helper()
+	checkTreap(t, z.treap, want)
+	if len(z.elements) != len(want) {
+		t.Fatalf("%d elements, want %d", len(z.elements), len(want))
+	}
+	z.treap.Each(func(node *TreapNode) {
+		if z.elements[node.value] != node {
+			t.Fatalf("%s: element points to another node", node.value)
+		}
+	})
+}
+
+// TestZSetModel runs random operations on a sorted set and on a sorted
+// slice side by side.
+func TestZSetModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const key = "treap-test"
+
+	var model []zsetEntry
+	z := NewZSET()
+	o := &Object{typ: "zset", value: z}
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+	DB.Set(key, o)
+	defer DB.Delete(key)
+
+	reset := func(next *ZSET) {
+		z = next
+		o.value = z
+	}
+	remove := func(keep func(i int, e zsetEntry) bool) []zsetEntry {
+		var kept, removed []zsetEntry
+		for i, e := range model {
+			if keep(i, e) {
+				kept = append(kept, e)
+			} else {
+				removed = append(removed, e)
+			}
+		}
+		model = kept
+		return removed
+	}
+
+	for i := 0; i < 5000; i++ {
+		n := len(model)
+		op := rng.Intn(10)
+		switch op {
+		case 0, 1, 2:
+			e := zsetEntry{fmt.Sprintf("m%d", rng.Intn(60)), float64(rng.Intn(8))}
+			z.Add(e.member, e.score)
+			remove(func(_ int, m zsetEntry) bool { return m.member != e.member })
+			j, _ := slices.BinarySearchFunc(model, e, func(a, b zsetEntry) int {
+				if a.less(b) {
+					return -1
+				}
+				return 1
+			})
+			model = slices.Insert(model, j, e)
+		case 3:
+			from, to := rng.Intn(n+2)-1, rng.Intn(n+2)-1
+			removed := z.removeRanks(key, o, from, to)
+			want := len(remove(func(i int, _ zsetEntry) bool { return i+1 < from || i+1 > to }))
+			if removed != want {
+				t.Fatalf("removeRanks(%d, %d) removed %d, want %d", from, to, removed, want)
+			}
+		case 4:
+			r := scoreRange{float64(rng.Intn(9) - 1), float64(rng.Intn(9) - 1), rng.Intn(2) == 0, rng.Intn(2) == 0}
+			removed := z.removeScores(key, o, r)
+			want := len(remove(func(_ int, e zsetEntry) bool { return !r.aboveMin(e.score) || !r.belowMax(e.score) }))
+			if removed != want {
+				t.Fatalf("removeScores(%+v) removed %d, want %d", r, removed, want)
+			}
+		case 5, 6:
+			reverse, count := rng.Intn(2) == 0, rng.Intn(5)
+			got := z.pop(key, o, reverse, count)
+			var want []zsetEntry
+			if reverse {
+				want = remove(func(i int, _ zsetEntry) bool { return i < n-count })
+				slices.Reverse(want)
+			} else {
+				want = remove(func(i int, _ zsetEntry) bool { return i >= count })
+			}
+			if !slices.Equal(got, want) {
+				t.Fatalf("pop(%v, %d) = %v, want %v", reverse, count, got, want)
+			}
+		case 7:
+			// the clone is used from now on and must not share nodes
+			c := z.Clone()
+			z.treap.SplitRank(z.treap.size)
+			reset(c)
+		case 8:
+			// rebuild from entries in order, reversed or shuffled, with
+			// stale scores for some members ahead of their current one
+			entries := slices.Clone(model)
+			switch rng.Intn(3) {
+			case 0:
+				slices.Reverse(entries)
+			case 1:
+				rng.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+			}
+			if n > 0 && rng.Intn(2) == 0 {
+				e := model[rng.Intn(n)]
+				entries = append([]zsetEntry{{e.member, e.score + 100}}, entries...)
+			}
+			reset(zsetFromEntries(entries))
+		case 9:
+			// splitting and merging back leaves the set as it was
+			k := rng.Intn(n + 1)
+			head := z.treap.SplitRank(k)
+			checkTreap(t, head, model[:k])
+			checkTreap(t, z.treap, model[k:])
+			head.Merge(z.treap)
+			z.treap = head
+		}
+		checkZSet(t, z, model)
+		// removals delete the key once they empty the set
+		if exists := DB.Peek(key) != nil; n > 0 && exists != (len(model) > 0) && op >= 3 && op <= 6 {
+			t.Fatalf("op %d: key exists %v with %d members", op, exists, len(model))
+		}
+		if DB.Peek(key) == nil {
+			DB.Set(key, o)
+		}
+	}
+}
+
+func TestBuildTreap(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 100, 10000} {
+		nodes := make([]*TreapNode, n)
+		want := make([]zsetEntry, n)
+		for i := range nodes {
+			want[i] = zsetEntry{fmt.Sprintf("m%05d", i), float64(i / 3)}
+			nodes[i] = NewTreapNode(want[i].score, want[i].member)
+		}
+		tr := BuildTreap(nodes)
+		checkTreap(t, tr, want)
+		for rank := 1; rank <= n; rank++ {
+			if node := tr.GetNodeByRank(rank); node.value != want[rank-1].member {
+				t.Fatalf("rank %d: got %s", rank, node.value)
+			}
+		}
+	}
+}
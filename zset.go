@@ -0,0 +1,1513 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ZSET struct {
+	treap    *Treap
+	elements map[string]*TreapNode
+}
+
+func NewZSET() *ZSET {
+	return &ZSET{treap: NewTreap(), elements: make(map[string]*TreapNode)}
+}
+
+func (z *ZSET) Clone() *ZSET {
+	c := &ZSET{treap: z.treap.Clone(), elements: make(map[string]*TreapNode, len(z.elements))}
+	c.treap.Each(func(node *TreapNode) {
+		c.elements[node.value] = node
+	})
+	return c
+}
+
+// Add sets member's score, reporting whether member is new.
+func (z *ZSET) Add(member string, score float64) bool {
+	node, exists := z.elements[member]
+	if exists {
+		if node.key == score {
+			return false
+		}
+		z.treap.Erase(node.key, member)
+	}
+	z.elements[member], _ = z.treap.Insert(score, member)
+	return !exists
+}
+
+func (z *ZSET) Remove(member string) bool {
+	node, exists := z.elements[member]
+	if !exists {
+		return false
+	}
+	z.treap.Erase(node.key, member)
+	delete(z.elements, member)
+	return true
+}
+
+// scoreRanks returns the ranks of the first and last member inside r;
+// from > to when there is none.
+func (z *ZSET) scoreRanks(r scoreRange) (from, to int) {
+	from = z.treap.CountBefore(func(node *TreapNode) bool {
+		return !r.aboveMin(node.key)
+	}) + 1
+	to = z.treap.CountBefore(func(node *TreapNode) bool {
+		return r.belowMax(node.key)
+	})
+	return from, to
+}
+
+// lexRanks is scoreRanks for a lex range. Lex ranges assume every member
+// has the same score, so the bounds are searched as (score, member) pairs
+// using the score of the first member.
+func (z *ZSET) lexRanks(r lexRange) (from, to int) {
+	n := z.treap.size
+	if n == 0 {
+		return 1, 0
+	}
+	score := z.treap.GetNodeByRank(1).key
+
+	switch {
+	case r.min.inf < 0:
+		from = 1
+	case r.min.inf > 0:
+		from = n + 1
+	case r.min.exclusive:
+		from = z.treap.UpperBound(score, r.min.value)
+	default:
+		from = z.treap.LowerBound(score, r.min.value)
+	}
+	switch {
+	case r.max.inf > 0:
+		to = n
+	case r.max.inf < 0:
+		to = 0
+	case r.max.exclusive:
+		to = z.treap.LowerBound(score, r.max.value) - 1
+	default:
+		to = z.treap.UpperBound(score, r.max.value) - 1
+	}
+	return from, to
+}
+
+// rangeReply returns the members ranked from to to, with their scores when
+// withScores is set.
+func (z *ZSET) rangeReply(from, to int, reverse, withScores bool) Value {
+	res := Value{typ: "array", array: []Value{}}
+	if withScores {
+		res.typ = "pairs"
+	}
+	z.treap.Walk(from, to, reverse, func(node *TreapNode) bool {
+		res.array = append(res.array, Value{typ: "bulk", bulk: node.value})
+		if withScores {
+			res.array = append(res.array, Value{typ: "double", dbl: node.key})
+		}
+		return true
+	})
+	return res
+}
+
+// removeRanks deletes the members ranked from to to and returns how many
+// there were. The key is deleted once the set is empty.
+func (z *ZSET) removeRanks(key string, o *Object, from, to int) int {
+	from, to = max(from, 1), min(to, z.treap.size)
+	if from > to {
+		return 0
+	}
+	head := z.treap.SplitRank(from - 1)
+	removed := z.treap.SplitRank(to - from + 1)
+	head.Merge(z.treap)
+	z.treap = head
+	return z.drop(key, o, removed)
+}
+
+// removeScores is removeRanks for the members inside r.
+func (z *ZSET) removeScores(key string, o *Object, r scoreRange) int {
+	head := z.treap.SplitBefore(func(node *TreapNode) bool {
+		return !r.aboveMin(node.key)
+	})
+	removed := z.treap.SplitBefore(func(node *TreapNode) bool {
+		return r.belowMax(node.key)
+	})
+	head.Merge(z.treap)
+	z.treap = head
+	return z.drop(key, o, removed)
+}
+
+// drop forgets the members of removed, which has been split off the tree,
+// and returns how many there were. The key is deleted once the set is
+// empty.
+func (z *ZSET) drop(key string, o *Object, removed *Treap) int {
+	removed.Each(func(node *TreapNode) {
+		delete(z.elements, node.value)
+		DB.Grow(o, -zsetEntrySize(node.value))
+	})
+	if z.treap.size == 0 {
+		DB.Delete(key)
+	}
+	return removed.size
+}
+
+// pop removes up to count members from the low end of the set, or the high
+// end when reverse is set, and returns them in the order they were popped.
+// The key is deleted once the set is empty.
+func (z *ZSET) pop(key string, o *Object, reverse bool, count int) []zsetEntry {
+	var removed *Treap
+	if reverse {
+		removed = z.treap
+		z.treap = removed.SplitRank(max(removed.size-count, 0))
+	} else {
+		removed = z.treap.SplitRank(count)
+	}
+	entries := make([]zsetEntry, 0, removed.size)
+	removed.Walk(1, removed.size, reverse, func(node *TreapNode) bool {
+		entries = append(entries, zsetEntry{node.value, node.key})
+		return true
+	})
+	z.drop(key, o, removed)
+	return entries
+}
+
+// rankRange converts start and stop indexes, negative ones counting back
+// from the end, into 1-based ranks; from > to when the range is empty.
+func rankRange(start, stop, n int) (from, to int) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	stop = min(stop, n-1)
+	return start + 1, stop + 1
+}
+
+// parseScore parses a sorted set score: any float including inf, +inf and
+// -inf, but not nan.
+func parseScore(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// scoreRange is a score interval as given to ZRANGEBYSCORE and friends:
+// each bound is inclusive unless written with a leading '('.
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func parseScoreRange(min, max string) (scoreRange, bool) {
+	var r scoreRange
+	var ok1, ok2 bool
+	r.min, r.minex, ok1 = parseScoreBound(min)
+	r.max, r.maxex, ok2 = parseScoreBound(max)
+	return r, ok1 && ok2
+}
+
+func parseScoreBound(s string) (float64, bool, bool) {
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	f, ok := parseScore(s)
+	return f, exclusive, ok
+}
+
+func (r scoreRange) aboveMin(score float64) bool {
+	if r.minex {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r scoreRange) belowMax(score float64) bool {
+	if r.maxex {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+// lexRange is a member interval as given to ZRANGEBYLEX: each bound
+// is "[member" (inclusive), "(member" (exclusive), "-" or "+".
+type lexRange struct {
+	min, max lexBound
+}
+
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int // -1 for "-", 1 for "+"
+}
+
+func parseLexRange(min, max string) (lexRange, bool) {
+	var r lexRange
+	var ok1, ok2 bool
+	r.min, ok1 = parseLexBound(min)
+	r.max, ok2 = parseLexBound(max)
+	return r, ok1 && ok2
+}
+
+func parseLexBound(s string) (lexBound, bool) {
+	switch {
+	case s == "-":
+		return lexBound{inf: -1}, true
+	case s == "+":
+		return lexBound{inf: 1}, true
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, true
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], exclusive: true}, true
+	}
+	return lexBound{}, false
+}
+
+// lookupZSet is the common start of the read-only sorted set commands. A
+// missing key is an empty set. The caller must hold DB.mu.
+func lookupZSet(key string) (*ZSET, bool) {
+	o, ok := DB.LookupType(key, "zset")
+	if !ok || o == nil {
+		return nil, ok
+	}
+	return o.value.(*ZSET), true
+}
+
+func zadd(args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "zadd wrong number of arguments"}
+	}
+	key := args[0].bulk
+
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	if nx && xx {
+		return Value{typ: "error", str: "ERR XX and NX options at the same time are not compatible"}
+	}
+	if gt && lt || nx && (gt || lt) {
+		return Value{typ: "error", str: "ERR GT, LT, and/or NX options at the same time are not compatible"}
+	}
+	if incr && len(pairs) > 2 {
+		return Value{typ: "error", str: "ERR INCR option supports a single increment-element pair"}
+	}
+
+	// every score is checked before anything is added
+	scores := make([]float64, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, ok := parseScore(pairs[i].bulk)
+		if !ok {
+			return Value{typ: "error", str: "ERR value is not a valid float"}
+		}
+		scores = append(scores, score)
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "zset")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		if xx {
+			if incr {
+				return Value{typ: "null"}
+			}
+			return Value{typ: "integer", num: 0}
+		}
+		o = &Object{typ: "zset", value: NewZSET()}
+		DB.Set(key, o)
+	}
+	zset := o.value.(*ZSET)
+
+	added, updated := 0, 0
+	result := Value{typ: "null"}
+	for i, score := range scores {
+		member := pairs[2*i+1].bulk
+		node, exists := zset.elements[member]
+		if !exists {
+			if xx {
+				continue
+			}
+			zset.Add(member, score)
+			DB.Grow(o, zsetEntrySize(member))
+			added++
+			result = Value{typ: "double", dbl: score}
+			continue
+		}
+
+		if nx {
+			continue
+		}
+		if incr {
+			score += node.key
+			if math.IsNaN(score) {
+				return Value{typ: "error", str: "ERR resulting score is not a number (NaN)"}
+			}
+		}
+		if lt && score >= node.key || gt && score <= node.key {
+			continue
+		}
+		if score != node.key {
+			zset.Add(member, score)
+			updated++
+		}
+		result = Value{typ: "double", dbl: score}
+	}
+	if zset.treap.size == 0 {
+		DB.Delete(key)
+	}
+
+	if incr {
+		return result
+	}
+	if ch {
+		return Value{typ: "integer", num: added + updated}
+	}
+	return Value{typ: "integer", num: added}
+}
+
+func zincrby(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "zincrby wrong number of arguments"}
+	}
+	key, member := args[0].bulk, args[2].bulk
+	incr, ok := parseScore(args[1].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR value is not a valid float"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "zset")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		o = &Object{typ: "zset", value: NewZSET()}
+		DB.Set(key, o)
+	}
+	zset := o.value.(*ZSET)
+
+	score := incr
+	if node, exists := zset.elements[member]; exists {
+		score += node.key
+		if math.IsNaN(score) {
+			return Value{typ: "error", str: "ERR resulting score is not a number (NaN)"}
+		}
+	}
+	if zset.Add(member, score) {
+		DB.Grow(o, zsetEntrySize(member))
+	}
+	return Value{typ: "double", dbl: score}
+}
+
+func zscore(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "zscore wrong number of arguments"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	zset, ok := lookupZSet(args[0].bulk)
+	if !ok {
+		return WrongType
+	}
+	if zset == nil {
+		return Value{typ: "null"}
+	}
+	node, exists := zset.elements[args[1].bulk]
+	if !exists {
+		return Value{typ: "null"}
+	}
+	return Value{typ: "double", dbl: node.key}
+}
+
+func zmscore(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "zmscore wrong number of arguments"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	zset, ok := lookupZSet(args[0].bulk)
+	if !ok {
+		return WrongType
+	}
+	res := Value{typ: "array", array: []Value{}}
+	for _, arg := range args[1:] {
+		if zset == nil {
+			res.array = append(res.array, Value{typ: "null"})
+		} else if node, exists := zset.elements[arg.bulk]; exists {
+			res.array = append(res.array, Value{typ: "double", dbl: node.key})
+		} else {
+			res.array = append(res.array, Value{typ: "null"})
+		}
+	}
+	return res
+}
+
+func zrank(args []Value) Value {
+	return zrankGeneric("zrank", args, false)
+}
+
+func zrevrank(args []Value) Value {
+	return zrankGeneric("zrevrank", args, true)
+}
+
+func zrankGeneric(name string, args []Value, reverse bool) Value {
+	if len(args) != 2 && len(args) != 3 {
+		return Value{typ: "error", str: name + " wrong number of arguments"}
+	}
+	withScore := len(args) == 3
+	if withScore && strings.ToUpper(args[2].bulk) != "WITHSCORE" {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	zset, ok := lookupZSet(args[0].bulk)
+	if !ok {
+		return WrongType
+	}
+	null := Value{typ: "null"}
+	if withScore {
+		null = Value{typ: "nullarray"}
+	}
+	if zset == nil {
+		return null
+	}
+	node, exists := zset.elements[args[1].bulk]
+	if !exists {
+		return null
+	}
+
+	rank := zset.treap.Rank(node.key, node.value) - 1
+	if reverse {
+		rank = zset.treap.size - 1 - rank
+	}
+	if withScore {
+		return Value{typ: "array", array: []Value{{typ: "integer", num: rank}, {typ: "double", dbl: node.key}}}
+	}
+	return Value{typ: "integer", num: rank}
+}
+
+func zcount(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "zcount wrong number of arguments"}
+	}
+	r, ok := parseScoreRange(args[1].bulk, args[2].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR min or max is not a float"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	zset, ok := lookupZSet(args[0].bulk)
+	if !ok {
+		return WrongType
+	}
+	if zset == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	from, to := zset.scoreRanks(r)
+	return Value{typ: "integer", num: max(to-from+1, 0)}
+}
+
+// zrangeSpec describes a range query: by "rank", "score" or "lex", and how
+// the result is ordered, cut and shown.
+type zrangeSpec struct {
+	by         string
+	rev        bool
+	withScores bool
+	limit      bool
+	offset     int
+	count      int
+}
+
+func zrange(args []Value) Value {
+	return zrangeGeneric("zrange", args, zrangeSpec{by: "rank"}, true)
+}
+
+func zrevrange(args []Value) Value {
+	return zrangeGeneric("zrevrange", args, zrangeSpec{by: "rank", rev: true}, false)
+}
+
+func zrangebyscore(args []Value) Value {
+	return zrangeGeneric("zrangebyscore", args, zrangeSpec{by: "score"}, false)
+}
+
+func zrevrangebyscore(args []Value) Value {
+	return zrangeGeneric("zrevrangebyscore", args, zrangeSpec{by: "score", rev: true}, false)
+}
+
+// zrangeGeneric implements ZRANGE and the older commands it subsumes.
+// Only ZRANGE itself takes BYSCORE, BYLEX and REV. Reversed score and lex
+// ranges are given max first.
+func zrangeGeneric(name string, args []Value, spec zrangeSpec, byOptions bool) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: name + " wrong number of arguments"}
+	}
+	key := args[0].bulk
+	start, stop := args[1].bulk, args[2].bulk
+
+	spec.count = -1
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch {
+		case opt == "WITHSCORES":
+			spec.withScores = true
+		case opt == "LIMIT" && i+2 < len(args) && name != "zrevrange":
+			offset, err1 := strconv.Atoi(args[i+1].bulk)
+			count, err2 := strconv.Atoi(args[i+2].bulk)
+			if err1 != nil || err2 != nil {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+			spec.limit, spec.offset, spec.count = true, offset, count
+			i += 2
+		case opt == "BYSCORE" && byOptions:
+			spec.by = "score"
+		case opt == "BYLEX" && byOptions:
+			spec.by = "lex"
+		case opt == "REV" && byOptions:
+			spec.rev = true
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+	if spec.limit && spec.by == "rank" {
+		return Value{typ: "error", str: "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"}
+	}
+	if spec.withScores && spec.by == "lex" {
+		return Value{typ: "error", str: "ERR syntax error, WITHSCORES not supported in combination with BYLEX"}
+	}
+	if spec.rev && spec.by != "rank" {
+		start, stop = stop, start
+	}
+
+	var startIndex, stopIndex int
+	var scores scoreRange
+	var lex lexRange
+	switch spec.by {
+	case "rank":
+		var err1, err2 error
+		startIndex, err1 = strconv.Atoi(start)
+		stopIndex, err2 = strconv.Atoi(stop)
+		if err1 != nil || err2 != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+	case "score":
+		var ok bool
+		if scores, ok = parseScoreRange(start, stop); !ok {
+			return Value{typ: "error", str: "ERR min or max is not a float"}
+		}
+	case "lex":
+		var ok bool
+		if lex, ok = parseLexRange(start, stop); !ok {
+			return Value{typ: "error", str: "ERR min or max not valid string range item"}
+		}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	zset, ok := lookupZSet(key)
+	if !ok {
+		return WrongType
+	}
+	if zset == nil {
+		return Value{typ: "array", array: []Value{}}
+	}
+
+	var from, to int
+	switch spec.by {
+	case "rank":
+		n := zset.treap.size
+		from, to = rankRange(startIndex, stopIndex, n)
+		if spec.rev {
+			from, to = n+1-to, n+1-from
+		}
+	case "score":
+		from, to = zset.scoreRanks(scores)
+	case "lex":
+		from, to = zset.lexRanks(lex)
+	}
+
+	if spec.limit {
+		if spec.offset < 0 {
+			return Value{typ: "array", array: []Value{}}
+		}
+		if spec.rev {
+			to -= spec.offset
+			if spec.count >= 0 {
+				from = max(from, to-spec.count+1)
+			}
+		} else {
+			from += spec.offset
+			if spec.count >= 0 {
+				to = min(to, from+spec.count-1)
+			}
+		}
+	}
+	return zset.rangeReply(from, to, spec.rev, spec.withScores)
+}
+
+func zrangebylex(args []Value) Value {
+	return zrangeGeneric("zrangebylex", args, zrangeSpec{by: "lex"}, false)
+}
+
+func zrevrangebylex(args []Value) Value {
+	return zrangeGeneric("zrevrangebylex", args, zrangeSpec{by: "lex", rev: true}, false)
+}
+
+func zlexcount(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "zlexcount wrong number of arguments"}
+	}
+	r, ok := parseLexRange(args[1].bulk, args[2].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR min or max not valid string range item"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	zset, ok := lookupZSet(args[0].bulk)
+	if !ok {
+		return WrongType
+	}
+	if zset == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	from, to := zset.lexRanks(r)
+	return Value{typ: "integer", num: max(to-from+1, 0)}
+}
+
+func zremrangebyrank(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "zremrangebyrank wrong number of arguments"}
+	}
+	key := args[0].bulk
+	start, err1 := strconv.Atoi(args[1].bulk)
+	stop, err2 := strconv.Atoi(args[2].bulk)
+	if err1 != nil || err2 != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "zset")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	zset := o.value.(*ZSET)
+
+	from, to := rankRange(start, stop, zset.treap.size)
+	return Value{typ: "integer", num: zset.removeRanks(key, o, from, to)}
+}
+
+func zremrangebyscore(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "zremrangebyscore wrong number of arguments"}
+	}
+	key := args[0].bulk
+	r, ok := parseScoreRange(args[1].bulk, args[2].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR min or max is not a float"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "zset")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	zset := o.value.(*ZSET)
+
+	return Value{typ: "integer", num: zset.removeScores(key, o, r)}
+}
+
+func zrem(args []Value) Value {
+	n := len(args)
+	if n < 2 {
+		return Value{typ: "error", str: "zrem wrong number of arguments"}
+	}
+	key := args[0].bulk
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "zset")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	zset := o.value.(*ZSET)
+
+	cnt := 0
+	for i := 1; i < n; i++ {
+		value := args[i].bulk
+		if zset.Remove(value) {
+			DB.Grow(o, -zsetEntrySize(value))
+			cnt++
+		}
+	}
+	if zset.treap.size == 0 {
+		DB.Delete(key)
+	}
+
+	return Value{typ: "integer", num: cnt}
+}
+
+func zcard(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "zard wrong number of arguments"}
+	}
+	key := args[0].bulk
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "zset")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	return Value{typ: "integer", num: o.value.(*ZSET).treap.size}
+}
+
+func zremrangebylex(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "zremrangebylex wrong number of arguments"}
+	}
+	key := args[0].bulk
+	r, ok := parseLexRange(args[1].bulk, args[2].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR min or max not valid string range item"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "zset")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	zset := o.value.(*ZSET)
+
+	from, to := zset.lexRanks(r)
+	return Value{typ: "integer", num: zset.removeRanks(key, o, from, to)}
+}
+
+// zsetSource is an input of the set algebra commands: a sorted set, or a
+// plain set whose members all score 1. A missing key is an empty source.
+type zsetSource struct {
+	zset *ZSET
+	set  map[string]struct{}
+}
+
+func lookupSource(key string) (zsetSource, bool) {
+	o := DB.Lookup(key)
+	switch {
+	case o == nil:
+		return zsetSource{}, true
+	case o.typ == "zset":
+		return zsetSource{zset: o.value.(*ZSET)}, true
+	case o.typ == "set":
+		return zsetSource{set: o.value.(map[string]struct{})}, true
+	}
+	return zsetSource{}, false
+}
+
+func (s zsetSource) len() int {
+	if s.zset != nil {
+		return len(s.zset.elements)
+	}
+	return len(s.set)
+}
+
+func (s zsetSource) score(member string) (float64, bool) {
+	if s.zset != nil {
+		node, ok := s.zset.elements[member]
+		if !ok {
+			return 0, false
+		}
+		return node.key, true
+	}
+	_, ok := s.set[member]
+	return 1, ok
+}
+
+// each calls fn on every member until fn returns false.
+func (s zsetSource) each(fn func(member string, score float64) bool) {
+	if s.zset != nil {
+		for member, node := range s.zset.elements {
+			if !fn(member, node.key) {
+				return
+			}
+		}
+		return
+	}
+	for member := range s.set {
+		if !fn(member, 1) {
+			return
+		}
+	}
+}
+
+// zsetOp holds the parsed arguments of ZUNION, ZINTER and ZDIFF and their
+// STORE forms.
+type zsetOp struct {
+	keys       []string
+	weights    []float64
+	aggregate  string
+	withScores bool
+	limit      int
+}
+
+// parseZSetOp parses "numkeys key [key ...]" and the options that follow.
+// kind is "union", "inter", "diff" or "intercard"; each takes a different
+// set of options.
+func parseZSetOp(name string, args []Value, kind string, store bool) (zsetOp, Value, bool) {
+	op := zsetOp{aggregate: "SUM"}
+
+	numkeys, err := strconv.Atoi(args[0].bulk)
+	if err != nil {
+		return op, Value{typ: "error", str: "ERR value is not an integer or out of range"}, false
+	}
+	if numkeys <= 0 {
+		if kind == "intercard" {
+			return op, Value{typ: "error", str: "ERR numkeys should be greater than 0"}, false
+		}
+		return op, Value{typ: "error", str: "ERR at least 1 input key is needed for '" + name + "' command"}, false
+	}
+	if numkeys > len(args)-1 {
+		return op, Value{typ: "error", str: "ERR syntax error"}, false
+	}
+	for _, arg := range args[1 : 1+numkeys] {
+		op.keys = append(op.keys, arg.bulk)
+	}
+
+	weighted := kind == "union" || kind == "inter"
+	for i := 1 + numkeys; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch {
+		case opt == "WEIGHTS" && weighted && i+numkeys < len(args):
+			op.weights = op.weights[:0]
+			for _, arg := range args[i+1 : i+1+numkeys] {
+				weight, ok := parseScore(arg.bulk)
+				if !ok {
+					return op, Value{typ: "error", str: "ERR weight value is not a float"}, false
+				}
+				op.weights = append(op.weights, weight)
+			}
+			i += numkeys
+		case opt == "AGGREGATE" && weighted && i+1 < len(args):
+			op.aggregate = strings.ToUpper(args[i+1].bulk)
+			if op.aggregate != "SUM" && op.aggregate != "MIN" && op.aggregate != "MAX" {
+				return op, Value{typ: "error", str: "ERR syntax error"}, false
+			}
+			i++
+		case opt == "WITHSCORES" && !store && kind != "intercard":
+			op.withScores = true
+		case opt == "LIMIT" && kind == "intercard" && i+1 < len(args):
+			limit, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return op, Value{typ: "error", str: "ERR value is not an integer or out of range"}, false
+			}
+			if limit < 0 {
+				return op, Value{typ: "error", str: "ERR LIMIT can't be negative"}, false
+			}
+			op.limit = limit
+			i++
+		default:
+			return op, Value{typ: "error", str: "ERR syntax error"}, false
+		}
+	}
+	return op, Value{}, true
+}
+
+func (op zsetOp) weight(i int) float64 {
+	if op.weights == nil {
+		return 1
+	}
+	return op.weights[i]
+}
+
+// weigh multiplies a score by a weight, where inf times 0 is 0 as in Redis.
+func weigh(score, weight float64) float64 {
+	if score = score * weight; math.IsNaN(score) {
+		return 0
+	}
+	return score
+}
+
+func (op zsetOp) combine(a, b float64) float64 {
+	switch op.aggregate {
+	case "MIN":
+		return math.Min(a, b)
+	case "MAX":
+		return math.Max(a, b)
+	}
+	// inf + -inf is 0 as well
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+// sources looks up every input key. The caller must hold DB.mu.
+func (op zsetOp) sources() ([]zsetSource, bool) {
+	sources := make([]zsetSource, 0, len(op.keys))
+	for _, key := range op.keys {
+		source, ok := lookupSource(key)
+		if !ok {
+			return nil, false
+		}
+		sources = append(sources, source)
+	}
+	return sources, true
+}
+
+func (op zsetOp) union(sources []zsetSource) map[string]float64 {
+	result := map[string]float64{}
+	for i, source := range sources {
+		weight := op.weight(i)
+		source.each(func(member string, score float64) bool {
+			score = weigh(score, weight)
+			if old, ok := result[member]; ok {
+				score = op.combine(old, score)
+			}
+			result[member] = score
+			return true
+		})
+	}
+	return result
+}
+
+// inter walks the smallest input and probes the others, stopping once it
+// found limit members when limit is positive.
+func (op zsetOp) inter(sources []zsetSource, limit int) map[string]float64 {
+	smallest := 0
+	for i, source := range sources {
+		if source.len() < sources[smallest].len() {
+			smallest = i
+		}
+	}
+
+	result := map[string]float64{}
+	sources[smallest].each(func(member string, _ float64) bool {
+		var total float64
+		for i, source := range sources {
+			score, ok := source.score(member)
+			if !ok {
+				return true
+			}
+			score = weigh(score, op.weight(i))
+			if i == 0 {
+				total = score
+			} else {
+				total = op.combine(total, score)
+			}
+		}
+		result[member] = total
+		return limit <= 0 || len(result) < limit
+	})
+	return result
+}
+
+func (op zsetOp) diff(sources []zsetSource) map[string]float64 {
+	result := map[string]float64{}
+	sources[0].each(func(member string, score float64) bool {
+		for _, source := range sources[1:] {
+			if _, ok := source.score(member); ok {
+				return true
+			}
+		}
+		result[member] = score
+		return true
+	})
+	return result
+}
+
+type zsetEntry struct {
+	member string
+	score  float64
+}
+
+// sortedEntries orders a result by score and then member, the order of a
+// sorted set.
+func sortedEntries(result map[string]float64) []zsetEntry {
+	entries := make([]zsetEntry, 0, len(result))
+	for member, score := range result {
+		entries = append(entries, zsetEntry{member, score})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].less(entries[j])
+	})
+	return entries
+}
+
+func (e zsetEntry) less(o zsetEntry) bool {
+	if e.score != o.score {
+		return e.score < o.score
+	}
+	return e.member < o.member
+}
+
+// zsetFromEntries builds a sorted set in O(n) from entries in order, as
+// they come from our snapshots, Redis listpacks and sortedEntries. Redis
+// skiplists, ours included, are saved highest first, so reversed entries
+// are flipped, and any other order is sorted first. A repeated member keeps its last score, as
+// if the entries had been added one at a time.
+func zsetFromEntries(entries []zsetEntry) *ZSET {
+	index := make(map[string]int, len(entries))
+	unique := entries[:0]
+	for _, e := range entries {
+		if i, ok := index[e.member]; ok {
+			unique[i].score = e.score
+			continue
+		}
+		index[e.member] = len(unique)
+		unique = append(unique, e)
+	}
+	entries = unique
+
+	ordered := func(i, j int) bool { return entries[i].less(entries[j]) }
+	reversed := func(i, j int) bool { return entries[j].less(entries[i]) }
+	if !sort.SliceIsSorted(entries, ordered) {
+		if sort.SliceIsSorted(entries, reversed) {
+			slices.Reverse(entries)
+		} else {
+			sort.Slice(entries, ordered)
+		}
+	}
+
+	z := &ZSET{elements: make(map[string]*TreapNode, len(entries))}
+	nodes := make([]*TreapNode, len(entries))
+	for i, e := range entries {
+		nodes[i] = NewTreapNode(e.score, e.member)
+		z.elements[e.member] = nodes[i]
+	}
+	z.treap = BuildTreap(nodes)
+	return z
+}
+
+func zunion(args []Value) Value {
+	return zsetAlgebra("zunion", "union", args, false)
+}
+
+func zinter(args []Value) Value {
+	return zsetAlgebra("zinter", "inter", args, false)
+}
+
+func zdiff(args []Value) Value {
+	return zsetAlgebra("zdiff", "diff", args, false)
+}
+
+func zunionstore(args []Value) Value {
+	return zsetAlgebra("zunionstore", "union", args, true)
+}
+
+func zinterstore(args []Value) Value {
+	return zsetAlgebra("zinterstore", "inter", args, true)
+}
+
+func zdiffstore(args []Value) Value {
+	return zsetAlgebra("zdiffstore", "diff", args, true)
+}
+
+// zsetAlgebra implements the union, intersection and difference commands.
+// The STORE forms take a destination key first, which is replaced by the
+// result or deleted when the result is empty.
+func zsetAlgebra(name, kind string, args []Value, store bool) Value {
+	var dest string
+	if store {
+		if len(args) < 3 {
+			return Value{typ: "error", str: name + " wrong number of arguments"}
+		}
+		dest, args = args[0].bulk, args[1:]
+	} else if len(args) < 2 {
+		return Value{typ: "error", str: name + " wrong number of arguments"}
+	}
+
+	op, errValue, ok := parseZSetOp(name, args, kind, store)
+	if !ok {
+		return errValue
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	sources, ok := op.sources()
+	if !ok {
+		return WrongType
+	}
+	var result map[string]float64
+	switch kind {
+	case "union":
+		result = op.union(sources)
+	case "inter":
+		result = op.inter(sources, 0)
+	default:
+		result = op.diff(sources)
+	}
+	entries := sortedEntries(result)
+
+	if store {
+		if len(entries) == 0 {
+			DB.Delete(dest)
+			return Value{typ: "integer", num: 0}
+		}
+		DB.Set(dest, &Object{typ: "zset", value: zsetFromEntries(entries)})
+		return Value{typ: "integer", num: len(entries)}
+	}
+
+	res := Value{typ: "array", array: make([]Value, 0, len(entries))}
+	if op.withScores {
+		res.typ = "pairs"
+	}
+	for _, e := range entries {
+		res.array = append(res.array, Value{typ: "bulk", bulk: e.member})
+		if op.withScores {
+			res.array = append(res.array, Value{typ: "double", dbl: e.score})
+		}
+	}
+	return res
+}
+
+func zintercard(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "zintercard wrong number of arguments"}
+	}
+	op, errValue, ok := parseZSetOp("zintercard", args, "intercard", false)
+	if !ok {
+		return errValue
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	sources, ok := op.sources()
+	if !ok {
+		return WrongType
+	}
+	return Value{typ: "integer", num: len(op.inter(sources, op.limit))}
+}
+
+func zpopmin(args []Value) Value {
+	return zpopGeneric("zpopmin", args, false)
+}
+
+func zpopmax(args []Value) Value {
+	return zpopGeneric("zpopmax", args, true)
+}
+
+func zpopGeneric(name string, args []Value, reverse bool) Value {
+	if len(args) != 1 && len(args) != 2 {
+		return Value{typ: "error", str: name + " wrong number of arguments"}
+	}
+	key := args[0].bulk
+
+	count := 1
+	res := Value{typ: "array", array: []Value{}}
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+		if n < 0 {
+			return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+		}
+		count = n
+		res.typ = "pairs"
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	o, ok := DB.LookupType(key, "zset")
+	if !ok {
+		return WrongType
+	}
+	if o == nil {
+		return res
+	}
+	for _, e := range o.value.(*ZSET).pop(key, o, reverse, count) {
+		res.array = append(res.array, Value{typ: "bulk", bulk: e.member}, Value{typ: "double", dbl: e.score})
+	}
+	return res
+}
+
+// popCommand is the ZPOPMIN or ZPOPMAX that a blocking pop is logged as,
+// naming the key it was served from.
+func popCommand(key string, reverse bool, count int) Value {
+	name := "ZPOPMIN"
+	if reverse {
+		name = "ZPOPMAX"
+	}
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: name},
+		{typ: "bulk", bulk: key},
+		{typ: "bulk", bulk: strconv.Itoa(count)},
+	}}
+}
+
+func bzpopmin(c *Client, args []Value) Value {
+	return bzpopGeneric("bzpopmin", c, args, false)
+}
+
+func bzpopmax(c *Client, args []Value) Value {
+	return bzpopGeneric("bzpopmax", c, args, true)
+}
+
+func bzpopGeneric(name string, c *Client, args []Value, reverse bool) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: name + " wrong number of arguments"}
+	}
+	timeout, errValue, ok := parseTimeout(args[len(args)-1].bulk)
+	if !ok {
+		return errValue
+	}
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[:len(args)-1] {
+		keys = append(keys, arg.bulk)
+	}
+
+	return blockingPop(c, keys, timeout, func(key string, o *Object) (Value, Value) {
+		e := o.value.(*ZSET).pop(key, o, reverse, 1)[0]
+		reply := Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: key},
+			{typ: "bulk", bulk: e.member},
+			{typ: "double", dbl: e.score},
+		}}
+		return reply, popCommand(key, reverse, 1)
+	})
+}
+
+// zmpopArgs holds what ZMPOP and BZMPOP share:
+// numkeys key [key ...] MIN|MAX [COUNT count].
+type zmpopArgs struct {
+	keys    []string
+	reverse bool
+	count   int
+}
+
+func parseZMPop(args []Value) (zmpopArgs, Value, bool) {
+	p := zmpopArgs{count: 1}
+	syntaxErr := Value{typ: "error", str: "ERR syntax error"}
+
+	numkeys, err := strconv.Atoi(args[0].bulk)
+	if err != nil || numkeys <= 0 {
+		return p, Value{typ: "error", str: "ERR numkeys should be greater than 0"}, false
+	}
+	if numkeys > len(args)-2 {
+		return p, syntaxErr, false
+	}
+	for _, arg := range args[1 : 1+numkeys] {
+		p.keys = append(p.keys, arg.bulk)
+	}
+
+	switch strings.ToUpper(args[1+numkeys].bulk) {
+	case "MIN":
+	case "MAX":
+		p.reverse = true
+	default:
+		return p, syntaxErr, false
+	}
+
+	rest := args[2+numkeys:]
+	if len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(rest[0].bulk) != "COUNT" {
+			return p, syntaxErr, false
+		}
+		count, err := strconv.Atoi(rest[1].bulk)
+		if err != nil || count <= 0 {
+			return p, Value{typ: "error", str: "ERR count should be greater than 0"}, false
+		}
+		p.count = count
+	}
+	return p, Value{}, true
+}
+
+// mpopReply is the [key, [[member, score], ...]] reply of ZMPOP and BZMPOP.
+func mpopReply(key string, entries []zsetEntry) Value {
+	popped := Value{typ: "array", array: make([]Value, 0, len(entries))}
+	for _, e := range entries {
+		popped.array = append(popped.array, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: e.member},
+			{typ: "double", dbl: e.score},
+		}})
+	}
+	return Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, popped}}
+}
+
+func zmpop(args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "zmpop wrong number of arguments"}
+	}
+	p, errValue, ok := parseZMPop(args)
+	if !ok {
+		return errValue
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	for _, key := range p.keys {
+		o, ok := DB.LookupType(key, "zset")
+		if !ok {
+			return WrongType
+		}
+		if o != nil {
+			return mpopReply(key, o.value.(*ZSET).pop(key, o, p.reverse, p.count))
+		}
+	}
+	return Value{typ: "nullarray"}
+}
+
+func bzmpop(c *Client, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "bzmpop wrong number of arguments"}
+	}
+	timeout, errValue, ok := parseTimeout(args[0].bulk)
+	if !ok {
+		return errValue
+	}
+	p, errValue, ok := parseZMPop(args[1:])
+	if !ok {
+		return errValue
+	}
+
+	return blockingPop(c, p.keys, timeout, func(key string, o *Object) (Value, Value) {
+		entries := o.value.(*ZSET).pop(key, o, p.reverse, p.count)
+		return mpopReply(key, entries), popCommand(key, p.reverse, len(entries))
+	})
+}
+
+func zrandmember(args []Value) Value {
+	if len(args) < 1 || len(args) > 3 {
+		return Value{typ: "error", str: "zrandmember wrong number of arguments"}
+	}
+	key := args[0].bulk
+
+	count := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+		if n < -math.MaxInt64/2 || n > math.MaxInt64/2 {
+			return Value{typ: "error", str: "ERR value is out of range"}
+		}
+		count = n
+	}
+	withScores := false
+	if len(args) == 3 {
+		if strings.ToUpper(args[2].bulk) != "WITHSCORES" {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		withScores = true
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	zset, ok := lookupZSet(key)
+	if !ok {
+		return WrongType
+	}
+
+	if len(args) == 1 {
+		if zset == nil {
+			return Value{typ: "null"}
+		}
+		node := zset.treap.GetNodeByRank(rand.Intn(zset.treap.size) + 1)
+		return Value{typ: "bulk", bulk: node.value}
+	}
+
+	res := Value{typ: "array", array: []Value{}}
+	if withScores {
+		res.typ = "pairs"
+	}
+	if zset == nil || count == 0 {
+		return res
+	}
+	n := zset.treap.size
+	if count >= n {
+		return zset.rangeReply(1, n, false, withScores)
+	}
+
+	add := func(rank int) {
+		node := zset.treap.GetNodeByRank(rank)
+		res.array = append(res.array, Value{typ: "bulk", bulk: node.value})
+		if withScores {
+			res.array = append(res.array, Value{typ: "double", dbl: node.key})
+		}
+	}
+	// a negative count may return the same member more than once
+	if count < 0 {
+		for i := 0; i < -count; i++ {
+			add(rand.Intn(n) + 1)
+		}
+		return res
+	}
+	picked := make(map[int]bool, count)
+	for len(picked) < count {
+		rank := rand.Intn(n) + 1
+		if !picked[rank] {
+			picked[rank] = true
+			add(rank)
+		}
+	}
+	return res
+}